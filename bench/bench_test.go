@@ -0,0 +1,101 @@
+package raftbench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func fileLogStore(b *testing.B) (*raft.FileLogStore, func()) {
+	dir, err := ioutil.TempDir("", "raftbench")
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	store, err := raft.NewFileLogStore(dir, ioutil.Discard)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatalf("err: %s", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func fileStableStore(b *testing.B) (*raft.FileStableStore, func()) {
+	dir, err := ioutil.TempDir("", "raftbench")
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	store, err := raft.NewFileStableStore(filepath.Join(dir, "stable.bin"))
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatalf("err: %s", err)
+	}
+	return store, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func BenchmarkFileLogStore_FirstIndex(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	FirstIndex(b, store)
+}
+
+func BenchmarkFileLogStore_LastIndex(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	LastIndex(b, store)
+}
+
+func BenchmarkFileLogStore_GetLog(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	GetLog(b, store)
+}
+
+func BenchmarkFileLogStore_StoreLog(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	StoreLog(b, store)
+}
+
+func BenchmarkFileLogStore_StoreLogs(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	StoreLogs(b, store)
+}
+
+func BenchmarkFileLogStore_DeleteRange(b *testing.B) {
+	store, done := fileLogStore(b)
+	defer done()
+	DeleteRange(b, store)
+}
+
+func BenchmarkFileStableStore_Set(b *testing.B) {
+	store, done := fileStableStore(b)
+	defer done()
+	Set(b, store)
+}
+
+func BenchmarkFileStableStore_Get(b *testing.B) {
+	store, done := fileStableStore(b)
+	defer done()
+	Get(b, store)
+}
+
+func BenchmarkFileStableStore_SetUint64(b *testing.B) {
+	store, done := fileStableStore(b)
+	defer done()
+	SetUint64(b, store)
+}
+
+func BenchmarkFileStableStore_GetUint64(b *testing.B) {
+	store, done := fileStableStore(b)
+	defer done()
+	GetUint64(b, store)
+}
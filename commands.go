@@ -8,6 +8,33 @@ type RPCHeader struct {
 	// ProtocolVersion is the version of the protocol the sender is
 	// speaking.
 	ProtocolVersion ProtocolVersion
+
+	// ProtocolVersionMin and ProtocolVersionMax are the oldest and newest
+	// versions of the protocol the sender can understand. Leaders use them
+	// to negotiate which version to speak. Servers from before negotiation
+	// leave them 0.
+	ProtocolVersionMin ProtocolVersion
+	ProtocolVersionMax ProtocolVersion
+}
+
+// makeRPCHeader returns the header for a server speaking the given version of
+// the protocol.
+func makeRPCHeader(version ProtocolVersion) RPCHeader {
+	return RPCHeader{
+		ProtocolVersion:    version,
+		ProtocolVersionMin: ProtocolVersionMin,
+		ProtocolVersionMax: ProtocolVersionMax,
+	}
+}
+
+// versionMax returns the newest version of the protocol the sender can
+// understand. Servers from before negotiation don't say, so they're assumed
+// to understand only the version they speak.
+func (h RPCHeader) versionMax() ProtocolVersion {
+	if h.ProtocolVersionMax == 0 {
+		return h.ProtocolVersion
+	}
+	return h.ProtocolVersionMax
 }
 
 // WithRPCHeader is an interface that exposes the RPC header.
@@ -115,6 +142,15 @@ type AppendEntriesResponse struct {
 	// Last Log is a hint to help accelerate rebuilding slow nodes
 	LastLog Index
 
+	// ConflictTerm and ConflictIndex are set by followers speaking protocol
+	// version 4 or newer when PrevLogTerm doesn't match their log.
+	// ConflictTerm is the term of the follower's entry at PrevLogEntry, and
+	// ConflictIndex is the first index in the follower's log with that term.
+	// They let the leader skip back over a whole term of conflicting entries
+	// at once. Both are 0 otherwise.
+	ConflictTerm  Term
+	ConflictIndex Index
+
 	// We may not succeed if we have a conflicting entry
 	Success bool
 }
@@ -136,6 +172,16 @@ type RequestVoteRequest struct {
 	// Used to ensure safety
 	LastLogIndex Index
 	LastLogTerm  Term
+
+	// Used to indicate to peers if this vote was triggered by a leadership
+	// transfer. It is required for leadership transfer to work, because servers
+	// wouldn't vote otherwise if they are aware of an existing leader.
+	LeadershipTransfer bool
+
+	// Used to indicate that this is a pre-vote, which asks whether the peer
+	// would vote for the candidate in Term without disrupting the cluster. The
+	// peer neither updates its term nor records a vote when answering.
+	PreVote bool
 }
 
 // See WithRPCHeader.
@@ -157,6 +203,10 @@ type RequestVoteResponse struct {
 
 	// Is the vote granted.
 	Granted bool
+
+	// Set if the request was understood as a pre-vote. Servers running older
+	// code leave this unset, as they treat pre-votes as ordinary votes.
+	PreVote bool
 }
 
 // See WithRPCHeader.
@@ -209,3 +259,61 @@ type InstallSnapshotResponse struct {
 func (r *InstallSnapshotResponse) GetRPCHeader() RPCHeader {
 	return r.RPCHeader
 }
+
+// TimeoutNowRequest is the command used by a leader to signal another server to
+// start an election.
+type TimeoutNowRequest struct {
+	RPCHeader
+
+	// The current term of the leader.
+	Term Term
+
+	// The leader's network address.
+	Leader []byte
+}
+
+// See WithRPCHeader.
+func (r *TimeoutNowRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// TimeoutNowResponse is the response to TimeoutNowRequest.
+type TimeoutNowResponse struct {
+	RPCHeader
+
+	// Newer term if leader is out of date.
+	Term Term
+}
+
+// See WithRPCHeader.
+func (r *TimeoutNowResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// ReadIndexRequest is the command used by a follower to ask the leader for a
+// read index, so that it can serve a linearizable read locally.
+type ReadIndexRequest struct {
+	RPCHeader
+}
+
+// See WithRPCHeader.
+func (r *ReadIndexRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// ReadIndexResponse is the response returned from a ReadIndexRequest.
+type ReadIndexResponse struct {
+	RPCHeader
+
+	// The current term of the leader.
+	Term Term
+
+	// The leader's commit index, confirmed while it was still the leader.
+	// Reading from an FSM that has applied this index is linearizable.
+	Index Index
+}
+
+// See WithRPCHeader.
+func (r *ReadIndexResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"io"
 	"time"
-
-	log "github.com/mgutz/logxi/v1"
 )
 
 // These are the versions of the protocol (which includes RPC messages as
@@ -15,6 +13,14 @@ import (
 // the protocol version being spoken, some otherwise understood RPC messages
 // may be refused. See dispositionRPC for details of this logic.
 //
+// From version 3 on, versions are negotiated. Every RPC carries the range of
+// versions its sender understands, and a leader speaks the newest version
+// that every member of the latest membership understands, though never one
+// older than its configured ProtocolVersion. Followers speak whatever the
+// leader does. A rolling upgrade to a new library is therefore enough to
+// move a version 3 cluster onto a newer version; there's no need to change
+// ProtocolVersion afterwards.
+//
 // There are notes about the upgrade path in the description of the versions
 // below. If you are starting a fresh cluster then there's no reason not to
 // jump right to the latest protocol version. If you need to interoperate with
@@ -84,11 +90,26 @@ import (
 //    this protocol version, along with their server ID. The remove/add cycle
 //    is required to populate their server ID. Note that removing must be done
 //    by ID, which will be the old server's address.
+// 4: Adds ConflictTerm and ConflictIndex to AppendEntriesResponse, so that a
+//    leader can skip back over a follower's conflicting entries a term at a
+//    time instead of one batch at a time, and adds the range of understood
+//    versions to RPCHeader for negotiation. Servers that only understand
+//    version 3 reject RPCs sent with version 4, so keep ProtocolVersion at 3
+//    while upgrading and let negotiation switch to 4 once every server runs
+//    this library.
+// 5: Adds joint consensus membership changes (ChangeMembership), whose joint
+//    configuration entries carry OldServers. Servers that only understand
+//    version 4 would ignore them, so ChangeMembership is refused until the
+//    leader speaks version 5.
+// 6: Adds Metadata to Server, which AddVoterWithMetadata and
+//    AddNonvoterWithMetadata set. Servers that only understand version 5 drop
+//    it when decoding a membership, and would lose it if they became leader,
+//    so those calls are refused until the leader speaks version 6.
 type ProtocolVersion int
 
 const (
 	ProtocolVersionMin ProtocolVersion = 0
-	ProtocolVersionMax                 = 3
+	ProtocolVersionMax                 = 6
 )
 
 // These are versions of snapshots that this server can _understand_. Currently,
@@ -128,11 +149,12 @@ type Config struct {
 	// ProtocolVersion allows a Raft server to inter-operate with older
 	// Raft servers running an older version of the code. This is used to
 	// version the wire protocol as well as Raft-specific log entries that
-	// the server uses when _speaking_ to other servers. There is currently
-	// no auto-negotiation of versions so all servers must be manually
-	// configured with compatible versions. See ProtocolVersionMin and
-	// ProtocolVersionMax for the versions of the protocol that this server
-	// can _understand_.
+	// the server uses when _speaking_ to other servers. From version 3 on,
+	// this is the oldest version the server will speak, and it moves to newer
+	// ones once every server understands them; see the comments at the top
+	// of config.go. Below version 3, all servers must be manually configured
+	// with compatible versions. See ProtocolVersionMin and ProtocolVersionMax
+	// for the versions of the protocol that this server can _understand_.
 	ProtocolVersion ProtocolVersion
 
 	// HeartbeatTimeout specifies the time in follower state without
@@ -143,6 +165,14 @@ type Config struct {
 	// a leader before we attempt an election.
 	ElectionTimeout time.Duration
 
+	// PreVote enables a pre-vote round before each election. A candidate first
+	// asks the other voters whether they would vote for it in the next term,
+	// and only increments its term once a quorum says yes. This keeps a server
+	// rejoining after a partition from forcing the leader to step down. Every
+	// server in the cluster must run a version of the code that understands
+	// pre-votes before this is enabled.
+	PreVote bool
+
 	// MaxAppendEntries controls the maximum number of append entries
 	// to send at once. We want to strike a balance between efficiency
 	// and avoiding waste if the follower is going to reject because of
@@ -176,6 +206,21 @@ type Config struct {
 	// step down as leader.
 	LeaderLeaseTimeout time.Duration
 
+	// LeaseReads lets the leader answer ReadIndex from its lease instead of
+	// confirming leadership with a round of heartbeats. The lease starts when
+	// the leader last sent an RPC that a quorum of voters answered and lasts
+	// LeaderLeaseTimeout, less LeaseReadClockDrift. Followers won't vote for
+	// another candidate while they still hear from the leader, so no other
+	// leader can be elected during the lease. This relies on bounded clock
+	// drift between servers; when the lease has lapsed, reads fall back to a
+	// heartbeat round.
+	LeaseReads bool
+
+	// LeaseReadClockDrift bounds how far the clocks of any two servers may
+	// drift apart over one LeaderLeaseTimeout. It is subtracted from the
+	// lease used by LeaseReads.
+	LeaseReadClockDrift time.Duration
+
 	// StartAsLeader forces Raft to start in the leader state. This should
 	// never be used except for testing purposes, as it can cause a split-brain.
 	StartAsLeader bool
@@ -196,21 +241,26 @@ type Config struct {
 
 	// Logger is a user-provided logger. If nil, a logger writing to LogOutput
 	// is used.
-	Logger log.Logger
+	Logger Logger
+
+	// Metrics receives the server's counters and timings. If nil, they go to
+	// the armon/go-metrics global functions (see GlobalMetrics).
+	Metrics Metrics
 }
 
 // DefaultConfig returns a Config with usable defaults.
 func DefaultConfig() *Config {
 	return &Config{
-		ProtocolVersion:    ProtocolVersionMax,
-		HeartbeatTimeout:   1000 * time.Millisecond,
-		ElectionTimeout:    1000 * time.Millisecond,
-		MaxAppendEntries:   64,
-		ShutdownOnRemove:   true,
-		TrailingLogs:       10240,
-		SnapshotInterval:   120 * time.Second,
-		SnapshotThreshold:  8192,
-		LeaderLeaseTimeout: 500 * time.Millisecond,
+		ProtocolVersion:     ProtocolVersionMax,
+		HeartbeatTimeout:    1000 * time.Millisecond,
+		ElectionTimeout:     1000 * time.Millisecond,
+		MaxAppendEntries:    64,
+		ShutdownOnRemove:    true,
+		TrailingLogs:        10240,
+		SnapshotInterval:    120 * time.Second,
+		SnapshotThreshold:   8192,
+		LeaderLeaseTimeout:  500 * time.Millisecond,
+		LeaseReadClockDrift: 50 * time.Millisecond,
 	}
 }
 
@@ -251,6 +301,10 @@ func ValidateConfig(config *Config) error {
 	if config.LeaderLeaseTimeout > config.HeartbeatTimeout {
 		return fmt.Errorf("Leader lease timeout cannot be larger than heartbeat timeout")
 	}
+	if config.LeaseReads && (config.LeaseReadClockDrift < 0 ||
+		config.LeaseReadClockDrift >= config.LeaderLeaseTimeout) {
+		return fmt.Errorf("Lease read clock drift must be non-negative and less than leader lease timeout")
+	}
 	if config.ElectionTimeout < config.HeartbeatTimeout {
 		return fmt.Errorf("Election timeout must be equal or greater than Heartbeat Timeout")
 	}
@@ -0,0 +1,838 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// fileLogSegmentSize is the size past which FileLogStore starts a new
+	// segment file.
+	fileLogSegmentSize = 64 * 1024 * 1024
+
+	segmentSuffix      = ".log"
+	segmentIndexSuffix = ".idx"
+
+	// recordHeaderSize is the size of the header in front of each log entry
+	// in a segment: a CRC-32C of everything after it, the length of the
+	// payload, then the entry's index, term and type.
+	recordHeaderSize = 4 + 4 + 8 + 8 + 1
+
+	// indexEntrySize is the size of each entry in a segment's index sidecar:
+	// a log index followed by the offset of its record in the segment.
+	indexEntrySize = 8 + 8
+)
+
+var (
+	// errCorruptRecord is returned when a record fails its CRC or runs past
+	// the end of its segment.
+	errCorruptRecord = errors.New("corrupt log record")
+
+	// errFileLogStoreClosed is returned after FileLogStore.Close.
+	errFileLogStoreClosed = errors.New("log store is closed")
+
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// FileLogStore implements the LogStore interface with append-only segment
+// files on the local disk. Each entry is stored with a CRC, and each segment
+// has an index sidecar mapping log indexes to file offsets. Concurrent calls
+// to StoreLogs share fsyncs. On startup, a torn write at the end of the log is
+// detected and truncated away.
+//
+// DeleteRange can only remove a prefix or a suffix of the log, which is all
+// that Raft needs.
+type FileLogStore struct {
+	dir         string
+	logger      Logger
+	segmentSize int64
+
+	// lock protects everything below.
+	lock sync.RWMutex
+
+	// segments are ordered oldest first. New entries are appended to the
+	// last one. Every segment holds at least one entry.
+	segments []*logSegment
+
+	// firstIndex is persisted in the meta file. Entries below it have been
+	// deleted even if they're still in the first segment file.
+	firstIndex Index
+
+	nextSeq uint64
+	written uint64
+	closed  bool
+
+	// syncLock serializes fsyncs. synced is the value of written covered by
+	// the last fsync.
+	syncLock sync.Mutex
+	synced   uint64
+}
+
+// logSegment is a segment file and its index sidecar.
+type logSegment struct {
+	seq   uint64
+	file  *os.File
+	index *os.File
+
+	// size is the length of the valid records in file.
+	size int64
+
+	// entries has the index and offset of each live record. dropped counts
+	// the entries before them in the sidecar that were deleted as a prefix.
+	entries []segmentEntry
+	dropped int
+}
+
+type segmentEntry struct {
+	index  Index
+	offset int64
+}
+
+// fileLogMeta is stored on disk in the meta file.
+type fileLogMeta struct {
+	FirstIndex Index
+}
+
+// NewFileLogStoreWithLogger opens or creates a FileLogStore in the given
+// directory, recovering from any torn write left by a crash.
+func NewFileLogStoreWithLogger(dir string, logger Logger) (*FileLogStore, error) {
+	if logger == nil {
+		logger = DefaultStdLogger(os.Stderr)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("log path not accessible: %v", err)
+	}
+	store := &FileLogStore{
+		dir:         dir,
+		logger:      logger,
+		segmentSize: fileLogSegmentSize,
+	}
+	if err := store.open(); err != nil {
+		store.closeSegments()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewFileLogStore opens or creates a FileLogStore in the given directory,
+// recovering from any torn write left by a crash.
+func NewFileLogStore(dir string, logOutput io.Writer) (*FileLogStore, error) {
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	return NewFileLogStoreWithLogger(dir, DefaultStdLogger(logOutput))
+}
+
+// open loads the meta file and segments from disk.
+func (s *FileLogStore) open() error {
+	metaData, err := ioutil.ReadFile(filepath.Join(s.dir, metaFilePath))
+	if err == nil {
+		var meta fileLogMeta
+		if err := json.Unmarshal(metaData, &meta); err != nil {
+			return fmt.Errorf("failed to decode log meta: %v", err)
+		}
+		s.firstIndex = meta.FirstIndex
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read log meta: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to scan log dir: %v", err)
+	}
+	var seqs []uint64
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			s.logger.Warn("Ignoring unknown file in log dir", "name", name)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for i, seq := range seqs {
+		s.nextSeq = seq + 1
+		seg, err := s.openSegment(seq, i == len(seqs)-1)
+		if err != nil {
+			return err
+		}
+		if len(seg.entries) == 0 {
+			if err := s.removeSegment(seg); err != nil {
+				return err
+			}
+			continue
+		}
+		if n := len(s.segments); n > 0 && seg.firstIndex() <= s.segments[n-1].lastIndex() {
+			seg.close()
+			return fmt.Errorf("log segment %s overlaps the one before it", s.segmentPath(seq))
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	// Finish any prefix deletion that was interrupted by a crash.
+	if len(s.segments) > 0 && s.segments[0].firstIndex() < s.firstIndex {
+		if err := s.deletePrefixLocked(s.firstIndex - 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentPath returns the path of the segment file with the given sequence
+// number. Its index sidecar has the same path with segmentIndexSuffix.
+func (s *FileLogStore) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// openSegment opens a segment file and its sidecar, checks them against each
+// other and repairs the sidecar if needed. A torn write is truncated away if
+// this is the last segment; elsewhere it's an error.
+func (s *FileLogStore) openSegment(seq uint64, last bool) (*logSegment, error) {
+	path := s.segmentPath(seq)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log segment: %v", err)
+	}
+	index, err := os.OpenFile(strings.TrimSuffix(path, segmentSuffix)+segmentIndexSuffix,
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open log segment index: %v", err)
+	}
+	seg := &logSegment{seq: seq, file: file, index: index}
+	if err := seg.recover(s.logger, last); err != nil {
+		seg.close()
+		return nil, fmt.Errorf("failed to recover log segment %s: %v", path, err)
+	}
+	return seg, nil
+}
+
+// recover loads the sidecar, trusting it as far as it agrees with the
+// segment, then scans the segment for any records after that.
+func (seg *logSegment) recover(logger Logger, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	indexData, err := ioutil.ReadAll(seg.index)
+	if err != nil {
+		return err
+	}
+
+	// The sidecar isn't synced on every write, so stop at the first entry
+	// that's out of order.
+	for i := 0; i+indexEntrySize <= len(indexData); i += indexEntrySize {
+		entry := segmentEntry{
+			index:  Index(binary.BigEndian.Uint64(indexData[i:])),
+			offset: int64(binary.BigEndian.Uint64(indexData[i+8:])),
+		}
+		if n := len(seg.entries); n == 0 && entry.offset != 0 ||
+			n > 0 && (entry.index <= seg.entries[n-1].index || entry.offset <= seg.entries[n-1].offset) ||
+			entry.offset >= fileSize {
+			break
+		}
+		seg.entries = append(seg.entries, entry)
+	}
+	indexOK := len(seg.entries)*indexEntrySize == len(indexData)
+
+	// Check the last entry the sidecar points to, and rescan the whole
+	// segment if it's bad.
+	var log Log
+	if n := len(seg.entries); n > 0 {
+		entry := seg.entries[n-1]
+		size, err := readRecord(seg.file, entry.offset, fileSize, &log)
+		if err == nil && log.Index == entry.index {
+			seg.size = entry.offset + size
+		} else {
+			seg.entries = nil
+			indexOK = false
+		}
+	}
+
+	// Pick up records that made it to the segment but not the sidecar.
+	for seg.size < fileSize {
+		size, err := readRecord(seg.file, seg.size, fileSize, &log)
+		if err != nil {
+			break
+		}
+		if n := len(seg.entries); n > 0 && log.Index <= seg.entries[n-1].index {
+			break
+		}
+		seg.entries = append(seg.entries, segmentEntry{index: log.Index, offset: seg.size})
+		seg.size += size
+		indexOK = false
+	}
+
+	if seg.size < fileSize {
+		if !last {
+			return fmt.Errorf("corrupt record at offset %d", seg.size)
+		}
+		logger.Warn("Truncating torn write at end of log",
+			"segment", seg.file.Name(),
+			"offset", seg.size,
+			"size", fileSize)
+		if err := seg.file.Truncate(seg.size); err != nil {
+			return err
+		}
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if !indexOK {
+		indexData = indexData[:0]
+		for _, entry := range seg.entries {
+			indexData = appendIndexEntry(indexData, entry)
+		}
+		if err := seg.index.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := seg.index.WriteAt(indexData, 0); err != nil {
+			return err
+		}
+		if err := seg.index.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstIndex returns the index of the segment's first live entry.
+func (seg *logSegment) firstIndex() Index {
+	return seg.entries[0].index
+}
+
+// lastIndex returns the index of the segment's last entry.
+func (seg *logSegment) lastIndex() Index {
+	return seg.entries[len(seg.entries)-1].index
+}
+
+// sync flushes the segment to disk. A segment that was closed in the
+// meantime was either synced or deleted, so that isn't an error.
+func (seg *logSegment) sync(withIndex bool) error {
+	if err := seg.file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	if withIndex {
+		if err := seg.index.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (seg *logSegment) close() error {
+	err := seg.file.Close()
+	if err2 := seg.index.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// readRecord reads the log entry whose record starts at off, which must end
+// by limit. It returns the size of the record.
+func readRecord(r io.ReaderAt, off int64, limit int64, log *Log) (int64, error) {
+	var header [recordHeaderSize]byte
+	if off+recordHeaderSize > limit {
+		return 0, errCorruptRecord
+	}
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		return 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[4:]))
+	if off+recordHeaderSize+length > limit {
+		return 0, errCorruptRecord
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, off+recordHeaderSize); err != nil {
+		return 0, err
+	}
+	crc := crc32.Update(0, castagnoliTable, header[4:])
+	crc = crc32.Update(crc, castagnoliTable, data)
+	if crc != binary.BigEndian.Uint32(header[:]) {
+		return 0, errCorruptRecord
+	}
+	log.Index = Index(binary.BigEndian.Uint64(header[8:]))
+	log.Term = Term(binary.BigEndian.Uint64(header[16:]))
+	log.Type = LogType(header[24])
+	log.Data = data
+	return recordHeaderSize + length, nil
+}
+
+// appendRecord appends the record for log to buf.
+func appendRecord(buf []byte, log *Log) []byte {
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[4:], uint32(len(log.Data)))
+	binary.BigEndian.PutUint64(header[8:], uint64(log.Index))
+	binary.BigEndian.PutUint64(header[16:], uint64(log.Term))
+	header[24] = byte(log.Type)
+	crc := crc32.Update(0, castagnoliTable, header[4:])
+	crc = crc32.Update(crc, castagnoliTable, log.Data)
+	binary.BigEndian.PutUint32(header[:], crc)
+	buf = append(buf, header[:]...)
+	return append(buf, log.Data...)
+}
+
+// appendIndexEntry appends the sidecar form of entry to buf.
+func appendIndexEntry(buf []byte, entry segmentEntry) []byte {
+	var b [indexEntrySize]byte
+	binary.BigEndian.PutUint64(b[:], uint64(entry.index))
+	binary.BigEndian.PutUint64(b[8:], uint64(entry.offset))
+	return append(buf, b[:]...)
+}
+
+// FirstIndex implements the LogStore interface.
+func (s *FileLogStore) FirstIndex() (Index, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.segments) == 0 {
+		return 0, nil
+	}
+	return s.segments[0].firstIndex(), nil
+}
+
+// LastIndex implements the LogStore interface.
+func (s *FileLogStore) LastIndex() (Index, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.segments) == 0 {
+		return 0, nil
+	}
+	return s.segments[len(s.segments)-1].lastIndex(), nil
+}
+
+// GetLog implements the LogStore interface.
+func (s *FileLogStore) GetLog(index Index, log *Log) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return errFileLogStoreClosed
+	}
+	i, j, ok := s.locateLocked(index)
+	if !ok {
+		return ErrLogNotFound
+	}
+	return s.readLocked(i, j, log)
+}
+
+// GetLogs implements the LogRangeStore interface.
+func (s *FileLogStore) GetLogs(min, max Index, maxBytes uint64) ([]*Log, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, errFileLogStoreClosed
+	}
+	i, j, ok := s.locateLocked(min)
+	if !ok {
+		return nil, ErrLogNotFound
+	}
+	var logs []*Log
+	var size uint64
+	for index := min; index <= max; index++ {
+		if j == len(s.segments[i].entries) {
+			i, j = i+1, 0
+		}
+		if i == len(s.segments) || s.segments[i].entries[j].index != index {
+			return nil, ErrLogNotFound
+		}
+		log := new(Log)
+		if err := s.readLocked(i, j, log); err != nil {
+			return nil, err
+		}
+		size += uint64(len(log.Data))
+		if maxBytes > 0 && size > maxBytes && len(logs) > 0 {
+			break
+		}
+		logs = append(logs, log)
+		j++
+	}
+	return logs, nil
+}
+
+// locateLocked finds the entry with the given index, returning the positions
+// of its segment and of the entry within that segment. The caller must hold
+// the lock.
+func (s *FileLogStore) locateLocked(index Index) (int, int, bool) {
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].lastIndex() >= index
+	})
+	if i == len(s.segments) {
+		return 0, 0, false
+	}
+	seg := s.segments[i]
+	j := sort.Search(len(seg.entries), func(j int) bool {
+		return seg.entries[j].index >= index
+	})
+	if j == len(seg.entries) || seg.entries[j].index != index {
+		return 0, 0, false
+	}
+	return i, j, true
+}
+
+// readLocked reads the entry at the given positions, as returned by
+// locateLocked. The caller must hold the lock.
+func (s *FileLogStore) readLocked(i, j int, log *Log) error {
+	seg := s.segments[i]
+	entry := seg.entries[j]
+	if _, err := readRecord(seg.file, entry.offset, seg.size, log); err != nil {
+		return fmt.Errorf("failed to read log %d: %v", entry.index, err)
+	}
+	if log.Index != entry.index {
+		return fmt.Errorf("failed to read log %d: found log %d in its place", entry.index, log.Index)
+	}
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (s *FileLogStore) StoreLog(log *Log) error {
+	return s.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. Logs at or below the current
+// last index replace the existing suffix of the log.
+func (s *FileLogStore) StoreLogs(logs []*Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Index <= logs[i-1].Index {
+			return fmt.Errorf("logs out of order: %d after %d", logs[i].Index, logs[i-1].Index)
+		}
+	}
+
+	s.lock.Lock()
+	err := s.appendLocked(logs)
+	written := s.written
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync(written)
+}
+
+// appendLocked writes logs to the segment files without syncing them. The
+// caller must hold the write lock.
+func (s *FileLogStore) appendLocked(logs []*Log) error {
+	if s.closed {
+		return errFileLogStoreClosed
+	}
+	if n := len(s.segments); n > 0 && logs[0].Index <= s.segments[n-1].lastIndex() {
+		if err := s.truncateLocked(logs[0].Index); err != nil {
+			return err
+		}
+	}
+	if len(s.segments) == 0 && logs[0].Index < s.firstIndex {
+		if err := s.setFirstIndex(0); err != nil {
+			return err
+		}
+	}
+
+	var buf, indexBuf []byte
+	for len(logs) > 0 {
+		n := len(s.segments)
+		if n == 0 || s.segments[n-1].size >= s.segmentSize {
+			if err := s.newSegmentLocked(); err != nil {
+				return err
+			}
+			n = len(s.segments)
+		}
+		seg := s.segments[n-1]
+
+		// Fill this segment up to its size limit.
+		buf, indexBuf = buf[:0], indexBuf[:0]
+		var entries []segmentEntry
+		for len(logs) > 0 && seg.size+int64(len(buf)) < s.segmentSize {
+			entry := segmentEntry{index: logs[0].Index, offset: seg.size + int64(len(buf))}
+			entries = append(entries, entry)
+			indexBuf = appendIndexEntry(indexBuf, entry)
+			buf = appendRecord(buf, logs[0])
+			logs = logs[1:]
+		}
+		if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+			return fmt.Errorf("failed to write log segment: %v", err)
+		}
+		slot := int64(seg.dropped+len(seg.entries)) * indexEntrySize
+		if _, err := seg.index.WriteAt(indexBuf, slot); err != nil {
+			return fmt.Errorf("failed to write log segment index: %v", err)
+		}
+		seg.size += int64(len(buf))
+		seg.entries = append(seg.entries, entries...)
+	}
+	s.written++
+	return nil
+}
+
+// sync makes sure everything up to the given write is on disk. If another
+// caller's fsync already covered it, there's nothing to do.
+func (s *FileLogStore) sync(written uint64) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	if s.synced >= written {
+		return nil
+	}
+
+	// Earlier segments were synced when they were sealed. The sidecar is
+	// rebuilt from the segment if needed, so it's only synced then too.
+	s.lock.RLock()
+	target := s.written
+	var seg *logSegment
+	if n := len(s.segments); n > 0 {
+		seg = s.segments[n-1]
+	}
+	s.lock.RUnlock()
+	if seg != nil {
+		if err := seg.sync(false); err != nil {
+			return fmt.Errorf("failed to sync log segment: %v", err)
+		}
+	}
+	s.synced = target
+	return nil
+}
+
+// newSegmentLocked seals the last segment and starts a new one. The caller
+// must hold the write lock.
+func (s *FileLogStore) newSegmentLocked() error {
+	if n := len(s.segments); n > 0 {
+		if err := s.segments[n-1].sync(true); err != nil {
+			return fmt.Errorf("failed to sync log segment: %v", err)
+		}
+	}
+	seq := s.nextSeq
+	path := s.segmentPath(seq)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create log segment: %v", err)
+	}
+	index, err := os.OpenFile(strings.TrimSuffix(path, segmentSuffix)+segmentIndexSuffix,
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to create log segment index: %v", err)
+	}
+	seg := &logSegment{seq: seq, file: file, index: index}
+	if err := syncDir(s.dir); err != nil {
+		seg.close()
+		return err
+	}
+	s.nextSeq++
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// removeSegment closes a segment and deletes its files.
+func (s *FileLogStore) removeSegment(seg *logSegment) error {
+	seg.close()
+	path := s.segmentPath(seg.seq)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove log segment: %v", err)
+	}
+	err := os.Remove(strings.TrimSuffix(path, segmentSuffix) + segmentIndexSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove log segment index: %v", err)
+	}
+	return nil
+}
+
+// DeleteRange implements the LogStore interface. The range must include the
+// first or the last log.
+func (s *FileLogStore) DeleteRange(min, max Index) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errFileLogStoreClosed
+	}
+	if len(s.segments) == 0 {
+		return nil
+	}
+	first := s.segments[0].firstIndex()
+	last := s.segments[len(s.segments)-1].lastIndex()
+	switch {
+	case max < first || min > last:
+		return nil
+	case min <= first:
+		return s.deletePrefixLocked(max)
+	case max >= last:
+		return s.truncateLocked(min)
+	default:
+		return fmt.Errorf("can't delete logs %d-%d from the middle of logs %d-%d",
+			min, max, first, last)
+	}
+}
+
+// deletePrefixLocked deletes every log up to and including max. Whole
+// segments are removed; the rest are hidden by raising firstIndex. The
+// caller must hold the write lock.
+func (s *FileLogStore) deletePrefixLocked(max Index) error {
+	if max >= s.segments[len(s.segments)-1].lastIndex() {
+		return s.truncateLocked(0)
+	}
+	if err := s.setFirstIndex(max + 1); err != nil {
+		return err
+	}
+	for s.segments[0].lastIndex() <= max {
+		if err := s.removeSegment(s.segments[0]); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	seg := s.segments[0]
+	i := sort.Search(len(seg.entries), func(i int) bool {
+		return seg.entries[i].index > max
+	})
+	seg.entries = seg.entries[i:]
+	seg.dropped += i
+	return nil
+}
+
+// truncateLocked deletes every log from min onwards. The caller must hold the
+// write lock.
+func (s *FileLogStore) truncateLocked(min Index) error {
+	removed := false
+	for len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+		i := sort.Search(len(seg.entries), func(i int) bool {
+			return seg.entries[i].index >= min
+		})
+		if i == 0 {
+			if err := s.removeSegment(seg); err != nil {
+				return err
+			}
+			s.segments = s.segments[:len(s.segments)-1]
+			removed = true
+			continue
+		}
+		if i < len(seg.entries) {
+			offset := seg.entries[i].offset
+			if err := seg.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate log segment: %v", err)
+			}
+			if err := seg.index.Truncate(int64(seg.dropped+i) * indexEntrySize); err != nil {
+				return fmt.Errorf("failed to truncate log segment index: %v", err)
+			}
+			seg.entries = seg.entries[:i]
+			seg.size = offset
+			if err := seg.sync(true); err != nil {
+				return fmt.Errorf("failed to sync log segment: %v", err)
+			}
+		}
+		break
+	}
+
+	// Removed segments must stay gone, or they'd come back after newer logs.
+	if removed {
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	if len(s.segments) == 0 && s.firstIndex != 0 {
+		return s.setFirstIndex(0)
+	}
+	return nil
+}
+
+// setFirstIndex persists a new firstIndex in the meta file.
+func (s *FileLogStore) setFirstIndex(index Index) error {
+	data, err := json.Marshal(&fileLogMeta{FirstIndex: index})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, metaFilePath), data); err != nil {
+		return fmt.Errorf("failed to write log meta: %v", err)
+	}
+	s.firstIndex = index
+	return nil
+}
+
+// Close syncs and closes the segment files. The store can't be used after
+// this.
+func (s *FileLogStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if n := len(s.segments); n > 0 {
+		err = s.segments[n-1].sync(true)
+	}
+	if err2 := s.closeSegments(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// closeSegments closes every segment's files.
+func (s *FileLogStore) closeSegments() error {
+	var err error
+	for _, seg := range s.segments {
+		if err2 := seg.close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so that after a crash
+// the file holds either its old contents or the new ones.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tmpSuffix
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that files created, renamed or removed in it
+// stay that way after a crash.
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fh.Sync()
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync dir %s: %v", dir, err)
+	}
+	return nil
+}
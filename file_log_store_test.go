@@ -0,0 +1,327 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testFileLogStore(t *testing.T, dir string) *FileLogStore {
+	store, err := NewFileLogStoreWithLogger(dir, newTestLogger(t))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Small segments so that tests span several of them
+	store.segmentSize = 256
+	return store
+}
+
+func testFileLog(index Index) *Log {
+	return &Log{
+		Index: index,
+		Term:  Term(index/10 + 1),
+		Type:  LogCommand,
+		Data:  []byte(fmt.Sprintf("log %d", index)),
+	}
+}
+
+func storeFileLogs(t *testing.T, store *FileLogStore, min, max Index) {
+	var logs []*Log
+	for i := min; i <= max; i++ {
+		logs = append(logs, testFileLog(i))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// expectFileLogs checks that the store holds exactly the logs min to max.
+func expectFileLogs(t *testing.T, store *FileLogStore, min, max Index) {
+	t.Helper()
+	if idx, _ := store.FirstIndex(); idx != min {
+		t.Fatalf("expected first index %d, got %d", min, idx)
+	}
+	if idx, _ := store.LastIndex(); idx != max {
+		t.Fatalf("expected last index %d, got %d", max, idx)
+	}
+	if min > 0 {
+		var out Log
+		if err := store.GetLog(min-1, &out); err != ErrLogNotFound {
+			t.Fatalf("expected log %d to be missing, got %v", min-1, err)
+		}
+	}
+	for i := min; i <= max && max > 0; i++ {
+		var out Log
+		if err := store.GetLog(i, &out); err != nil {
+			t.Fatalf("log %d err: %v", i, err)
+		}
+		expect := testFileLog(i)
+		if out.Index != expect.Index || out.Term != expect.Term ||
+			out.Type != expect.Type || !bytes.Equal(out.Data, expect.Data) {
+			t.Fatalf("bad log %d: %#v", i, out)
+		}
+	}
+	var out Log
+	if err := store.GetLog(max+1, &out); err != ErrLogNotFound {
+		t.Fatalf("expected log %d to be missing, got %v", max+1, err)
+	}
+}
+
+func TestFileLogStoreImpl(t *testing.T) {
+	var impl interface{} = &FileLogStore{}
+	if _, ok := impl.(LogStore); !ok {
+		t.Fatalf("FileLogStore not a LogStore")
+	}
+}
+
+func TestFileLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	expectFileLogs(t, store, 0, 0)
+	storeFileLogs(t, store, 1, 50)
+	if err := store.StoreLog(testFileLog(51)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectFileLogs(t, store, 1, 51)
+	if len(store.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(store.segments))
+	}
+
+	// Out of order logs are rejected
+	err = store.StoreLogs([]*Log{testFileLog(53), testFileLog(52)})
+	if err == nil {
+		t.Fatalf("expected out of order logs to fail")
+	}
+
+	// Everything survives a restart
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.GetLog(1, new(Log)); err != errFileLogStoreClosed {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+	store = testFileLogStore(t, dir)
+	defer store.Close()
+	expectFileLogs(t, store, 1, 51)
+	storeFileLogs(t, store, 52, 60)
+	expectFileLogs(t, store, 1, 60)
+}
+
+func TestFileLogStore_GetLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	defer store.Close()
+	storeFileLogs(t, store, 1, 50)
+
+	// The range spans several segments
+	logs, err := store.GetLogs(5, 45, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(logs) != 41 {
+		t.Fatalf("expected 41 logs, got %d", len(logs))
+	}
+	for i, log := range logs {
+		expect := testFileLog(Index(5 + i))
+		if log.Index != expect.Index || !bytes.Equal(log.Data, expect.Data) {
+			t.Fatalf("bad log: %#v", log)
+		}
+	}
+
+	// The size limit still returns at least one log
+	if logs, _ := store.GetLogs(5, 45, 1); len(logs) != 1 {
+		t.Fatalf("expected 1 log, got %d", len(logs))
+	}
+	if logs, _ := store.GetLogs(5, 45, 20); len(logs) != 4 {
+		t.Fatalf("expected 4 logs, got %d", len(logs))
+	}
+
+	if _, err := store.GetLogs(45, 55, 0); err != ErrLogNotFound {
+		t.Fatalf("expected missing logs to fail, got %v", err)
+	}
+}
+
+func TestFileLogStore_DeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	storeFileLogs(t, store, 1, 100)
+
+	// Compact a prefix, ending part way through a segment
+	if err := store.DeleteRange(1, 33); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectFileLogs(t, store, 34, 100)
+
+	// Truncate a suffix, starting part way through a segment
+	if err := store.DeleteRange(77, 100); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectFileLogs(t, store, 34, 76)
+
+	// The middle of the log can't be deleted
+	if err := store.DeleteRange(40, 50); err == nil {
+		t.Fatalf("expected deleting the middle to fail")
+	}
+
+	// Storing over the end replaces the suffix
+	storeFileLogs(t, store, 70, 90)
+	expectFileLogs(t, store, 34, 90)
+
+	// Both deletions survive a restart
+	store.Close()
+	store = testFileLogStore(t, dir)
+	expectFileLogs(t, store, 34, 90)
+
+	// Deleting everything allows starting over anywhere
+	if err := store.DeleteRange(0, 1000); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectFileLogs(t, store, 0, 0)
+	storeFileLogs(t, store, 5, 10)
+	store.Close()
+	store = testFileLogStore(t, dir)
+	defer store.Close()
+	expectFileLogs(t, store, 5, 10)
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected old segments to be removed, got %v", files)
+	}
+}
+
+func TestFileLogStore_TornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	storeFileLogs(t, store, 1, 20)
+	seg := store.segments[len(store.segments)-1]
+	segPath := seg.file.Name()
+	indexPath := seg.index.Name()
+	store.Close()
+
+	// Write half of a record to the segment, and garbage to the sidecar
+	half := appendRecord(nil, testFileLog(21))
+	half = half[:len(half)/2]
+	fh, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fh.Write(half)
+	fh.Close()
+	fh, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fh.Write([]byte("garbage"))
+	fh.Close()
+
+	store = testFileLogStore(t, dir)
+	expectFileLogs(t, store, 1, 20)
+	storeFileLogs(t, store, 21, 25)
+	store.Close()
+
+	// Lose the sidecar entirely; it's rebuilt from the segment
+	if err := os.Truncate(indexPath, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store = testFileLogStore(t, dir)
+	defer store.Close()
+	expectFileLogs(t, store, 1, 25)
+}
+
+func TestFileLogStore_CorruptSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	storeFileLogs(t, store, 1, 50)
+	segPath := store.segments[0].file.Name()
+	indexPath := store.segments[0].index.Name()
+	store.Close()
+
+	// Flip a byte in the first record of a segment that isn't the last
+	data, err := ioutil.ReadFile(segPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data[recordHeaderSize] ^= 0xff
+	if err := ioutil.WriteFile(segPath, data, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Truncate(indexPath, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileLogStoreWithLogger(dir, newTestLogger(t)); err == nil {
+		t.Fatalf("expected corruption to be reported")
+	}
+}
+
+func TestFileLogStore_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := testFileLogStore(t, dir)
+	defer store.Close()
+
+	// Writers take turns appending, then share fsyncs, as in StoreLogs
+	var wg sync.WaitGroup
+	next := Index(1)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				store.lock.Lock()
+				err := store.appendLocked([]*Log{testFileLog(next)})
+				next++
+				written := store.written
+				store.lock.Unlock()
+				if err == nil {
+					err = store.sync(written)
+				}
+				if err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+				last, _ := store.LastIndex()
+				if err := store.GetLog(last, new(Log)); err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expectFileLogs(t, store, 1, 100)
+}
@@ -14,8 +14,6 @@ import (
 	"sort"
 	"strings"
 	"time"
-
-	log "github.com/mgutz/logxi/v1"
 )
 
 const (
@@ -31,7 +29,7 @@ const (
 type FileSnapshotStore struct {
 	path   string
 	retain int
-	logger log.Logger
+	logger Logger
 }
 
 type snapMetaSlice []*fileSnapshotMeta
@@ -39,7 +37,7 @@ type snapMetaSlice []*fileSnapshotMeta
 // FileSnapshotSink implements SnapshotSink with a file.
 type FileSnapshotSink struct {
 	store  *FileSnapshotStore
-	logger log.Logger
+	logger Logger
 	dir    string
 	meta   fileSnapshotMeta
 
@@ -75,7 +73,7 @@ func (b *bufferedFile) Close() error {
 // NewFileSnapshotStoreWithLogger creates a new FileSnapshotStore based
 // on a base directory. The `retain` parameter controls how many
 // snapshots are retained. Must be at least 1.
-func NewFileSnapshotStoreWithLogger(base string, retain int, logger log.Logger) (*FileSnapshotStore, error) {
+func NewFileSnapshotStoreWithLogger(base string, retain int, logger Logger) (*FileSnapshotStore, error) {
 	if retain < 1 {
 		return nil, fmt.Errorf("must retain at least one snapshot")
 	}
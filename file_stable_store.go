@@ -0,0 +1,196 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	stableValue  = 0
+	stableUint64 = 1
+)
+
+// FileStableStore implements the StableStore interface with a single file on
+// the local disk. Every write replaces the whole file by writing a temporary
+// file, syncing it and renaming it into place, so a crash leaves either the
+// old or the new contents. The file has a checksum, so corruption is detected
+// when the store is opened. Missing keys return ErrKeyNotFound.
+//
+// FileStableStore also implements StableStoreBatch.
+type FileStableStore struct {
+	path string
+
+	// lock protects the maps and serializes writes to the file.
+	lock    sync.RWMutex
+	values  map[string][]byte
+	uint64s map[string]uint64
+}
+
+// NewFileStableStore opens the FileStableStore at path, creating it on the
+// first write if it doesn't exist.
+func NewFileStableStore(path string) (*FileStableStore, error) {
+	store := &FileStableStore{
+		path:    path,
+		values:  make(map[string][]byte),
+		uint64s: make(map[string]uint64),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stable store: %v", err)
+	}
+	if err := store.decode(data); err != nil {
+		return nil, fmt.Errorf("failed to load stable store %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// decode loads the file contents: a CRC-32C of the rest of the file, then for
+// each key its kind, the key and the value, with lengths as uvarints.
+func (f *FileStableStore) decode(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("file too short")
+	}
+	body := data[4:]
+	if crc32.Checksum(body, castagnoliTable) != binary.BigEndian.Uint32(data) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	readBytes := func() ([]byte, bool) {
+		n, size := binary.Uvarint(body)
+		if size <= 0 || n > uint64(len(body)-size) {
+			return nil, false
+		}
+		b := body[size : size+int(n)]
+		body = body[size+int(n):]
+		return b, true
+	}
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+		key, ok := readBytes()
+		if !ok {
+			return fmt.Errorf("bad key")
+		}
+		switch kind {
+		case stableValue:
+			val, ok := readBytes()
+			if !ok {
+				return fmt.Errorf("bad value for key %q", key)
+			}
+			f.values[string(key)] = append([]byte(nil), val...)
+		case stableUint64:
+			if len(body) < 8 {
+				return fmt.Errorf("bad value for key %q", key)
+			}
+			f.uint64s[string(key)] = binary.BigEndian.Uint64(body)
+			body = body[8:]
+		default:
+			return fmt.Errorf("unknown kind %d for key %q", kind, key)
+		}
+	}
+	return nil
+}
+
+// encodeStableStore returns the file contents for the given keys, in sorted
+// order.
+func encodeStableStore(values map[string][]byte, uint64s map[string]uint64) []byte {
+	appendBytes := func(buf []byte, b []byte) []byte {
+		var n [binary.MaxVarintLen64]byte
+		buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+		return append(buf, b...)
+	}
+
+	buf := make([]byte, 4)
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf = append(buf, stableValue)
+		buf = appendBytes(buf, []byte(key))
+		buf = appendBytes(buf, values[key])
+	}
+	keys = keys[:0]
+	for key := range uint64s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf = append(buf, stableUint64)
+		buf = appendBytes(buf, []byte(key))
+		var val [8]byte
+		binary.BigEndian.PutUint64(val[:], uint64s[key])
+		buf = append(buf, val[:]...)
+	}
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], castagnoliTable))
+	return buf
+}
+
+// SetBatch implements the StableStoreBatch interface.
+func (f *FileStableStore) SetBatch(writes []StableWrite) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Apply the writes to copies of the maps, so nothing changes if the file
+	// can't be written.
+	values := make(map[string][]byte, len(f.values)+len(writes))
+	for key, val := range f.values {
+		values[key] = val
+	}
+	uint64s := make(map[string]uint64, len(f.uint64s)+len(writes))
+	for key, val := range f.uint64s {
+		uint64s[key] = val
+	}
+	for _, w := range writes {
+		if w.IsUint64 {
+			uint64s[string(w.Key)] = w.Uint64
+		} else {
+			values[string(w.Key)] = append([]byte(nil), w.Val...)
+		}
+	}
+	if err := writeFileAtomic(f.path, encodeStableStore(values, uint64s)); err != nil {
+		return fmt.Errorf("failed to write stable store: %v", err)
+	}
+	f.values, f.uint64s = values, uint64s
+	return nil
+}
+
+// Set implements the StableStore interface.
+func (f *FileStableStore) Set(key []byte, val []byte) error {
+	return f.SetBatch([]StableWrite{{Key: key, Val: val}})
+}
+
+// Get implements the StableStore interface.
+func (f *FileStableStore) Get(key []byte) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	val, ok := f.values[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetUint64 implements the StableStore interface.
+func (f *FileStableStore) SetUint64(key []byte, val uint64) error {
+	return f.SetBatch([]StableWrite{{Key: key, IsUint64: true, Uint64: val}})
+}
+
+// GetUint64 implements the StableStore interface.
+func (f *FileStableStore) GetUint64(key []byte) (uint64, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	val, ok := f.uint64s[string(key)]
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	return val, nil
+}
@@ -0,0 +1,126 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStableStoreImpl(t *testing.T) {
+	var impl interface{} = &FileStableStore{}
+	if _, ok := impl.(StableStoreBatch); !ok {
+		t.Fatalf("FileStableStore not a StableStoreBatch")
+	}
+}
+
+func TestFileStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable.bin")
+
+	store, err := NewFileStableStore(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Missing keys are reported the way Raft expects
+	if _, err := store.Get([]byte("missing")); err == nil || err.Error() != "not found" {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, err := store.GetUint64([]byte("missing")); err == nil || err.Error() != "not found" {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err := store.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SetUint64(keyCurrentTerm, 5); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = store.SetBatch([]StableWrite{
+		{Key: keyLastVoteTerm, IsUint64: true, Uint64: 5},
+		{Key: keyLastVoteCand, Val: []byte("candidate")},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Everything survives reopening
+	store, err = NewFileStableStore(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if val, err := store.Get([]byte("key")); err != nil || !bytes.Equal(val, []byte("value")) {
+		t.Fatalf("bad: %q %v", val, err)
+	}
+	if val, err := store.Get(keyLastVoteCand); err != nil || !bytes.Equal(val, []byte("candidate")) {
+		t.Fatalf("bad: %q %v", val, err)
+	}
+	if val, err := store.GetUint64(keyCurrentTerm); err != nil || val != 5 {
+		t.Fatalf("bad: %d %v", val, err)
+	}
+	if val, err := store.GetUint64(keyLastVoteTerm); err != nil || val != 5 {
+		t.Fatalf("bad: %d %v", val, err)
+	}
+
+	// Corruption is detected on open
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileStableStore(path); err == nil {
+		t.Fatalf("expected corruption to be reported")
+	}
+}
+
+func TestFileStableStore_Raft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stable, err := NewFileStableStore(filepath.Join(dir, "stable.bin"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logs, err := NewFileLogStoreWithLogger(filepath.Join(dir, "logs"), newTestLogger(t))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer logs.Close()
+
+	conf := inmemConfig(t)
+	conf.LocalID = "server1"
+	_, snaps := FileSnapTest(t)
+	addr, trans := NewInmemTransport("")
+	membership := Membership{Servers: []Server{{Suffrage: Voter, ID: conf.LocalID, Address: addr}}}
+	if err := BootstrapCluster(conf, logs, stable, snaps, trans, membership); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r, err := NewRaft(conf, &MockFSM{}, logs, stable, snaps, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	select {
+	case <-r.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout becoming leader")
+	}
+	if err := r.Apply([]byte("test"), time.Second).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if term, err := stable.GetUint64(keyLastVoteTerm); err != nil || term == 0 {
+		t.Fatalf("expected a vote to be saved, got %d %v", term, err)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"io"
 	"time"
-
-	"github.com/armon/go-metrics"
 )
 
 // FSM provides an interface that can be implemented by
@@ -67,11 +65,12 @@ func (r *raftServer) runFSM() {
 				continue
 			}
 			source.Close()
-			metrics.MeasureSince([]string{"raft", "fsm", "restore"}, start)
+			r.metrics.MeasureSince([]string{"raft", "fsm", "restore"}, start)
 
 			// Update the last index and term
 			lastIndex = meta.Index
 			lastTerm = meta.Term
+			r.shared.setApplied(lastIndex)
 			req.respond(nil)
 
 		case req := <-r.fsmSnapshotCh:
@@ -84,7 +83,7 @@ func (r *raftServer) runFSM() {
 			// Start a snapshot
 			start := time.Now()
 			snap, err := r.fsm.Snapshot()
-			metrics.MeasureSince([]string{"raft", "fsm", "snapshot"}, start)
+			r.metrics.MeasureSince([]string{"raft", "fsm", "snapshot"}, start)
 
 			// Respond to the request
 			req.index = lastIndex
@@ -98,12 +97,16 @@ func (r *raftServer) runFSM() {
 			if commitEntry.log.Type == LogCommand {
 				start := time.Now()
 				resp = r.fsm.Apply(commitEntry.log)
-				metrics.MeasureSince([]string{"raft", "fsm", "apply"}, start)
+				r.metrics.MeasureSince([]string{"raft", "fsm", "apply"}, start)
 			}
 
-			// Update the indexes
-			lastIndex = commitEntry.log.Index
-			lastTerm = commitEntry.log.Term
+			// Update the indexes. Only entries that reach the FSM count toward
+			// snapshots.
+			if commitEntry.log.Type == LogCommand || commitEntry.log.Type == LogBarrier {
+				lastIndex = commitEntry.log.Index
+				lastTerm = commitEntry.log.Term
+			}
+			r.shared.setApplied(commitEntry.log.Index)
 
 			// Invoke the future if given
 			if commitEntry.future != nil {
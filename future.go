@@ -1,6 +1,13 @@
 package raft
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
 
 // Future is used to represent an action that may occur in the future.
 type Future interface {
@@ -13,6 +20,37 @@ type Future interface {
 	Error() error
 }
 
+// ContextFuture is a Future that can also be waited on with a context. Every
+// future returned by Raft implements it.
+type ContextFuture interface {
+	Future
+
+	// ErrorContext is like Error, but gives up and returns ctx.Err() once
+	// ctx is done. Giving up doesn't cancel the operation; a later call may
+	// still return its outcome.
+	ErrorContext(ctx context.Context) error
+}
+
+// ErrorContext is like f.Error, but gives up and returns ctx.Err() once ctx is
+// done. Futures that implement ContextFuture, which includes all those returned
+// by Raft, stop waiting right away. For any other future, Error keeps running
+// in the background, so it must not be called again until it has returned.
+func ErrorContext(ctx context.Context, f Future) error {
+	if cf, ok := f.(ContextFuture); ok {
+		return cf.ErrorContext(ctx)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.Error()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // IndexFuture is used for future actions that can result in a raft log entry
 // being created.
 type IndexFuture interface {
@@ -33,6 +71,19 @@ type ApplyFuture interface {
 	Response() interface{}
 }
 
+// ApplyBatchFuture is used for ApplyBatch and can return the FSM responses.
+type ApplyBatchFuture interface {
+	// Index holds the index of the first entry in the batch; the rest follow
+	// it contiguously. This must not be called until after the Error method
+	// has returned.
+	IndexFuture
+
+	// Responses returns the FSM responses as returned by the FSM.Apply
+	// method, one for each command in the batch. This must not be called
+	// until after the Error method has returned.
+	Responses() []interface{}
+}
+
 // MembershipFuture is used for GetMembership and can return the
 // latest membership configuration in use by Raft.
 type MembershipFuture interface {
@@ -43,6 +94,24 @@ type MembershipFuture interface {
 	Membership() Membership
 }
 
+// SnapshotFuture is used for waiting on a user-triggered snapshot to complete.
+type SnapshotFuture interface {
+	Future
+
+	// Open is a function you can call to access the underlying snapshot and
+	// its metadata, such as to make a backup. This must not be called until
+	// after the Error method has returned, and may only be called once. The
+	// caller must close the returned reader. The snapshot is opened before
+	// Error returns, so it stays readable even if later snapshots have since
+	// reaped it.
+	Open() (*SnapshotMeta, io.ReadCloser, error)
+
+	// Close releases the snapshot if Open hasn't handed it over, after which
+	// Open fails. Callers that don't Open the snapshot should call Close so
+	// it doesn't hold a file open until the future is garbage collected.
+	Close() error
+}
+
 // errorFuture is used to return a static error.
 type errorFuture struct {
 	err error
@@ -52,6 +121,10 @@ func (e errorFuture) Error() error {
 	return e.err
 }
 
+func (e errorFuture) ErrorContext(ctx context.Context) error {
+	return e.err
+}
+
 func (e errorFuture) Response() interface{} {
 	return nil
 }
@@ -93,6 +166,23 @@ func (d *deferError) Error() error {
 	return d.err
 }
 
+func (d *deferError) ErrorContext(ctx context.Context) error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.errCh == nil {
+		panic("waiting for response on nil channel")
+	}
+	select {
+	case d.err = <-d.errCh:
+	case <-d.shutdownCh:
+		d.err = ErrRaftShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return d.err
+}
+
 func (d *deferError) respond(err error) {
 	if d.errCh == nil {
 		return
@@ -129,6 +219,20 @@ type logFuture struct {
 	log      Log
 	response interface{}
 	dispatch time.Time
+
+	// Optional. If done before the leader dispatches the entry, the entry is
+	// dropped instead of being written to the log.
+	ctx context.Context
+}
+
+// cancelled reports whether the entry should be dropped because its context
+// is done, and if so, responds with the context's error.
+func (l *logFuture) cancelled() bool {
+	if l.ctx == nil || l.ctx.Err() == nil {
+		return false
+	}
+	l.respond(l.ctx.Err())
+	return true
 }
 
 func (l *logFuture) Response() interface{} {
@@ -139,6 +243,52 @@ func (l *logFuture) Index() Index {
 	return l.log.Index
 }
 
+// batchFuture is used for waiting on a batch of log entries to be applied.
+type batchFuture struct {
+	// err is set if the batch was never handed to the leader.
+	err     error
+	futures []*logFuture
+}
+
+func (b *batchFuture) Error() error {
+	if b.err != nil {
+		return b.err
+	}
+	for _, f := range b.futures {
+		if err := f.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batchFuture) ErrorContext(ctx context.Context) error {
+	if b.err != nil {
+		return b.err
+	}
+	for _, f := range b.futures {
+		if err := f.ErrorContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batchFuture) Index() Index {
+	if len(b.futures) == 0 {
+		return 0
+	}
+	return b.futures[0].Index()
+}
+
+func (b *batchFuture) Responses() []interface{} {
+	responses := make([]interface{}, len(b.futures))
+	for i, f := range b.futures {
+		responses[i] = f.Response()
+	}
+	return responses
+}
+
 type shutdownFuture struct {
 	raft *Raft
 }
@@ -148,9 +298,66 @@ func (s *shutdownFuture) Error() error {
 	return nil
 }
 
+func (s *shutdownFuture) ErrorContext(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		s.raft.goRoutines.waitShutdown()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // snapshotFuture is used for waiting on a snapshot to complete.
 type snapshotFuture struct {
 	deferError
+
+	// mu protects meta and reader, the opened snapshot. These are filled in
+	// before the future returns with no error, and cleared once Open hands
+	// them over or Close releases them.
+	mu     sync.Mutex
+	meta   *SnapshotMeta
+	reader io.ReadCloser
+}
+
+// opened stores the opened snapshot for Open to hand over. If the caller drops
+// the future without calling Open or Close, the snapshot is released when the
+// future is garbage collected.
+func (s *snapshotFuture) opened(meta *SnapshotMeta, reader io.ReadCloser) {
+	s.mu.Lock()
+	s.meta, s.reader = meta, reader
+	s.mu.Unlock()
+	runtime.SetFinalizer(s, (*snapshotFuture).Close)
+}
+
+// Open is a function you can call to access the underlying snapshot and its
+// metadata.
+func (s *snapshotFuture) Open() (*SnapshotMeta, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader == nil {
+		return nil, nil, fmt.Errorf("no snapshot available")
+	}
+	// Hand the snapshot over so it can't be opened multiple times.
+	meta, reader := s.meta, s.reader
+	s.meta, s.reader = nil, nil
+	return meta, reader, nil
+}
+
+// Close releases the snapshot if Open hasn't handed it over.
+func (s *snapshotFuture) Close() error {
+	s.mu.Lock()
+	reader := s.reader
+	s.meta, s.reader = nil, nil
+	s.mu.Unlock()
+	if reader == nil {
+		return nil
+	}
+	return reader.Close()
 }
 
 // reqSnapshotFuture is used for requesting a snapshot start.
@@ -171,10 +378,52 @@ type restoreFuture struct {
 	ID string
 }
 
+// userRestoreFuture is used for waiting on a user-triggered restore of an
+// external snapshot to complete.
+type userRestoreFuture struct {
+	deferError
+
+	// meta is the metadata that belongs with the snapshot.
+	meta *SnapshotMeta
+
+	// reader is the interface to read the snapshot contents from.
+	reader io.Reader
+}
+
+// leadershipTransferFuture is returned by LeadershipTransfer() and
+// LeadershipTransferToServer().
+type leadershipTransferFuture struct {
+	deferError
+
+	// ID and Address identify the server to hand off leadership to. If ID is
+	// empty, the leader picks the most up-to-date voter and fills them in.
+	ID      ServerID
+	Address ServerAddress
+}
+
 // verifyFuture is returned by VerifyLeader(), used to check that a majority of
-// the cluster still believes the local server to be the current leader.
+// the cluster still believes the local server to be the current leader. It's
+// also used by ReadIndex().
 type verifyFuture struct {
 	deferError
+
+	// index is the read index, set by the leader before it starts verifying
+	// leadership. See raftServer.readIndex.
+	index Index
+
+	// Optional. If done before the leader starts verifying, the request is
+	// dropped.
+	ctx context.Context
+}
+
+// cancelled reports whether the request should be dropped because its context
+// is done, and if so, responds with the context's error.
+func (v *verifyFuture) cancelled() bool {
+	if v.ctx == nil || v.ctx.Err() == nil {
+		return false
+	}
+	v.respond(v.ctx.Err())
+	return true
 }
 
 // membershipsFuture is used to retrieve the current memberships. This is
@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"testing"
 )
@@ -40,3 +41,103 @@ func TestDeferFutureConcurrent(t *testing.T) {
 		t.Errorf("unexpected error result; got %#v want %#v", got, want)
 	}
 }
+
+// The futures Raft returns can all be waited on with a context.
+var (
+	_ ContextFuture = errorFuture{}
+	_ ContextFuture = &logFuture{}
+	_ ContextFuture = &batchFuture{}
+	_ ContextFuture = &shutdownFuture{}
+	_ ContextFuture = &snapshotFuture{}
+	_ ContextFuture = &userRestoreFuture{}
+	_ ContextFuture = &leadershipTransferFuture{}
+	_ ContextFuture = &verifyFuture{}
+	_ ContextFuture = &membershipsFuture{}
+	_ ContextFuture = &statsFuture{}
+)
+
+// plainFuture is a Future that doesn't implement ContextFuture.
+type plainFuture chan error
+
+func (f plainFuture) Error() error {
+	return <-f
+}
+
+func TestErrorContext(t *testing.T) {
+	want := errors.New("x")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A plain Future is waited on in the background.
+	if got := ErrorContext(ctx, make(plainFuture)); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+	f := make(plainFuture, 1)
+	f <- want
+	if got := ErrorContext(context.Background(), f); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+
+	// A ContextFuture is asked directly.
+	var d deferError
+	d.init()
+	if got := ErrorContext(ctx, &d); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+	d.respond(want)
+	if got := ErrorContext(context.Background(), &d); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+}
+
+func TestDeferFutureErrorContext(t *testing.T) {
+	want := errors.New("x")
+	var f deferError
+	f.init()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := f.ErrorContext(ctx); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+	f.respond(want)
+	if got := f.ErrorContext(context.Background()); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+	if got := f.ErrorContext(ctx); got != want {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, want)
+	}
+}
+
+func TestLogFutureCancelled(t *testing.T) {
+	f := &logFuture{ctx: context.Background()}
+	f.init()
+	if f.cancelled() {
+		t.Fatalf("should not be cancelled")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.ctx = ctx
+	cancel()
+	if !f.cancelled() {
+		t.Fatalf("should be cancelled")
+	}
+	if got := f.Error(); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+}
+
+func TestVerifyFutureCancelled(t *testing.T) {
+	f := &verifyFuture{}
+	f.init()
+	if f.cancelled() {
+		t.Fatalf("should not be cancelled")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.ctx = ctx
+	cancel()
+	if !f.cancelled() {
+		t.Fatalf("should be cancelled")
+	}
+	if got := f.Error(); got != context.Canceled {
+		t.Fatalf("unexpected error result; got %#v want %#v", got, context.Canceled)
+	}
+}
@@ -53,6 +53,27 @@ func (i *InmemStore) GetLog(index Index, log *Log) error {
 	return nil
 }
 
+// GetLogs implements the LogRangeStore interface.
+func (i *InmemStore) GetLogs(min, max Index, maxBytes uint64) ([]*Log, error) {
+	i.l.RLock()
+	defer i.l.RUnlock()
+	var logs []*Log
+	var size uint64
+	for j := min; j <= max; j++ {
+		l, ok := i.logs[j]
+		if !ok {
+			return nil, ErrLogNotFound
+		}
+		size += uint64(len(l.Data))
+		if maxBytes > 0 && size > maxBytes && len(logs) > 0 {
+			break
+		}
+		entry := *l
+		logs = append(logs, &entry)
+	}
+	return logs, nil
+}
+
 // StoreLog implements the LogStore interface.
 func (i *InmemStore) StoreLog(log *Log) error {
 	return i.StoreLogs([]*Log{log})
@@ -123,3 +144,17 @@ func (i *InmemStore) GetUint64(key []byte) (uint64, error) {
 	defer i.l.RUnlock()
 	return i.kvInt[string(key)], nil
 }
+
+// SetBatch implements the StableStoreBatch interface.
+func (i *InmemStore) SetBatch(writes []StableWrite) error {
+	i.l.Lock()
+	defer i.l.Unlock()
+	for _, w := range writes {
+		if w.IsUint64 {
+			i.kvInt[string(w.Key)] = w.Uint64
+		} else {
+			i.kv[string(w.Key)] = w.Val
+		}
+	}
+	return nil
+}
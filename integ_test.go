@@ -7,8 +7,6 @@ import (
 	"os"
 	"testing"
 	"time"
-
-	log "github.com/mgutz/logxi/v1"
 )
 
 // CheckInteg will skip a test if integration testing is not enabled.
@@ -31,7 +29,7 @@ type RaftEnv struct {
 	snapshot *FileSnapshotStore
 	trans    *NetworkTransport
 	raft     *Raft
-	logger   log.Logger
+	logger   Logger
 }
 
 func (r *RaftEnv) Release() {
@@ -90,7 +88,7 @@ func MakeRaft(t *testing.T, conf *Config, bootstrap bool) *RaftEnv {
 		}
 	}
 
-	log.Info("Starting node at %v", trans.LocalAddr())
+	env.logger.Info("Starting node", "address", trans.LocalAddr())
 	raft, err := NewRaft(conf, env.fsm, stable, stable, snap, trans)
 	if err != nil {
 		t.Fatalf("err: %v", err)
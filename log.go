@@ -84,3 +84,62 @@ type LogStore interface {
 	// DeleteRange deletes a range of log entries. The range is inclusive.
 	DeleteRange(min, max Index) error
 }
+
+// LogRangeStore is an optional extension of LogStore for stores that can read
+// a range of log entries more cheaply than one at a time. When the LogStore
+// passed to NewRaft implements it, the leader uses it to read entries for
+// replication.
+type LogRangeStore interface {
+	LogStore
+
+	// GetLogs returns the log entries from min through max, in order. If
+	// maxBytes is nonzero, it stops before an entry that would bring the
+	// total size of the entries' Data past maxBytes, but it always returns
+	// at least one entry. It returns ErrLogNotFound if an entry in the range
+	// is missing.
+	GetLogs(min, max Index, maxBytes uint64) ([]*Log, error)
+}
+
+// getLogs reads the log entries from min through max as described for
+// LogRangeStore.GetLogs, falling back to GetLog for stores that don't
+// implement it.
+func getLogs(logs LogStore, min, max Index, maxBytes uint64) ([]*Log, error) {
+	if rangeStore, ok := logs.(LogRangeStore); ok {
+		return rangeStore.GetLogs(min, max, maxBytes)
+	}
+	var entries []*Log
+	var size uint64
+	for i := min; i <= max; i++ {
+		entry := new(Log)
+		if err := logs.GetLog(i, entry); err != nil {
+			return nil, err
+		}
+		size += uint64(len(entry.Data))
+		if maxBytes > 0 && size > maxBytes && len(entries) > 0 {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// searchLogTerms returns the smallest index from min through max whose log
+// entry's term satisfies f, or max+1 if there's none. Since terms never
+// decrease along the log, f must be false for some prefix of the range and
+// true for the rest, as in sort.Search.
+func searchLogTerms(logs LogStore, min, max Index, f func(Term) bool) (Index, error) {
+	lo, hi := min, max+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		var entry Log
+		if err := logs.GetLog(mid, &entry); err != nil {
+			return 0, err
+		}
+		if f(entry.Term) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
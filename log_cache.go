@@ -46,6 +46,53 @@ func (c *LogCache) GetLog(idx Index, log *Log) error {
 	return c.store.GetLog(idx, log)
 }
 
+// GetLogs implements the LogRangeStore interface. Entries are served from the
+// buffer up to the first miss, and the rest come from the backend store.
+func (c *LogCache) GetLogs(min, max Index, maxBytes uint64) ([]*Log, error) {
+	var logs []*Log
+	var size uint64
+	c.l.RLock()
+	for idx := min; idx <= max; idx++ {
+		cached := c.cache[uint64(idx)%uint64(len(c.cache))]
+		if cached == nil || cached.Index != idx {
+			break
+		}
+		size += uint64(len(cached.Data))
+		if maxBytes > 0 && size > maxBytes && len(logs) > 0 {
+			c.l.RUnlock()
+			return logs, nil
+		}
+		entry := *cached
+		logs = append(logs, &entry)
+	}
+	c.l.RUnlock()
+
+	// Forward the rest of the request on a cache miss
+	next := min + Index(len(logs))
+	if next > max {
+		return logs, nil
+	}
+	var budget uint64
+	if maxBytes > 0 {
+		if size >= maxBytes && len(logs) > 0 {
+			return logs, nil
+		}
+		budget = maxBytes - size
+	}
+	rest, err := getLogs(c.store, next, max, budget)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range rest {
+		size += uint64(len(entry.Data))
+		if maxBytes > 0 && size > maxBytes && len(logs) > 0 {
+			break
+		}
+		logs = append(logs, entry)
+	}
+	return logs, nil
+}
+
 func (c *LogCache) StoreLog(log *Log) error {
 	return c.StoreLogs([]*Log{log})
 }
@@ -86,3 +86,41 @@ func TestLogCache(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 }
+
+func TestLogCache_GetLogs(t *testing.T) {
+	store := NewInmemStore()
+	c, _ := NewLogCache(16, store)
+
+	// Logs 1-32 are only in the store, 33-40 are also in the ring buffer
+	for i := 0; i < 32; i++ {
+		store.StoreLog(&Log{Index: Index(i + 1), Data: []byte("data")})
+	}
+	for i := 32; i < 40; i++ {
+		c.StoreLog(&Log{Index: Index(i + 1), Data: []byte("data")})
+	}
+
+	check := func(min, max Index, maxBytes uint64, expectMax Index) {
+		logs, err := c.GetLogs(min, max, maxBytes)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(logs) != int(expectMax-min+1) {
+			t.Fatalf("expected logs %d-%d, got %d logs", min, expectMax, len(logs))
+		}
+		for i, log := range logs {
+			if log.Index != min+Index(i) {
+				t.Fatalf("bad: %#v", log)
+			}
+		}
+	}
+	check(35, 40, 0, 40)
+	check(20, 40, 0, 40)
+	check(20, 40, 10, 21)
+	check(35, 40, 10, 36)
+	check(38, 40, 1, 38)
+
+	// A missing log fails the whole request
+	if _, err := c.GetLogs(38, 41, 0); err != ErrLogNotFound {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -10,8 +10,28 @@ import (
 	"strings"
 	"sync"
 	"time"
+)
+
+// Logger is the structured logger used throughout this package. Each method
+// takes a message followed by alternating keys and values, for example
+// logger.Info("Removed peer", "id", id, "address", addr).
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// With returns a Logger that adds keyvals to every message.
+	With(keyvals ...interface{}) Logger
+}
 
-	log "github.com/mgutz/logxi/v1"
+// Log levels for NewRaftLogger and NewRaftLoggerWithWriter. The values match
+// logxi's, so its level constants may still be passed.
+const (
+	LogLevelError = 3
+	LogLevelWarn  = 4
+	LogLevelInfo  = 6
+	LogLevelDebug = 7
 )
 
 const (
@@ -26,42 +46,87 @@ var logLock sync.Mutex
 // DefaultStdLogger returns a Logger that logs to the supplied writer using the
 // defaults for logger (this is often a fallback way to get a logger inside the
 // library when one isn't supplied by the caller).
-func DefaultStdLogger(w io.Writer) log.Logger {
-	return NewRaftLoggerWithWriter(w, log.LevelInfo)
+func DefaultStdLogger(w io.Writer) Logger {
+	return NewRaftLoggerWithWriter(w, LogLevelInfo)
 }
 
-// NewRaftLogger creates a new logger with the specified level and a Raft
-// formatter.
-func NewRaftLogger(level int) log.Logger {
-	logger := log.New("raft")
-	return setLevelFormatter(logger, level, createRaftFormatter("", false))
+// NewRaftLogger creates a new logger writing to standard output with the
+// specified level and a Raft formatter.
+func NewRaftLogger(level int) Logger {
+	return NewRaftLoggerWithWriter(os.Stdout, level)
 }
 
 // NewRaftLoggerWithWriter creates a new logger with the specified level and
 // writer and a Raft formatter.
-func NewRaftLoggerWithWriter(w io.Writer, level int) log.Logger {
-	logger := log.NewLogger(w, "raft")
-	return setLevelFormatter(logger, level, createRaftFormatter("", false))
+func NewRaftLoggerWithWriter(w io.Writer, level int) Logger {
+	return &formatterLogger{
+		w:         w,
+		level:     level,
+		formatter: createRaftFormatter("", false),
+	}
 }
 
 // NewRaftLoggerForTesting creates a new logger with the specified tag, for use
 // in unit tests.
-func NewRaftLoggerForTesting(w io.Writer, tag string) log.Logger {
-	logger := log.NewLogger(w, "raft")
-	level := log.LevelDebug
-	return setLevelFormatter(logger, level, createRaftFormatter(tag, true))
+func NewRaftLoggerForTesting(w io.Writer, tag string) Logger {
+	return &formatterLogger{
+		w:         w,
+		level:     LogLevelDebug,
+		formatter: createRaftFormatter(tag, true),
+	}
+}
+
+// formatterLogger is a Logger that writes messages at or above level to w
+// using a raftFormatter.
+type formatterLogger struct {
+	w         io.Writer
+	level     int
+	formatter *raftFormatter
+	keyvals   []interface{}
+}
+
+func (l *formatterLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LogLevelDebug, msg, keyvals)
+}
+
+func (l *formatterLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LogLevelInfo, msg, keyvals)
+}
+
+func (l *formatterLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LogLevelWarn, msg, keyvals)
+}
+
+func (l *formatterLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LogLevelError, msg, keyvals)
+}
+
+func (l *formatterLogger) With(keyvals ...interface{}) Logger {
+	scoped := *l
+	scoped.keyvals = append(append([]interface{}{}, l.keyvals...), keyvals...)
+	return &scoped
+}
+
+func (l *formatterLogger) log(level int, msg string, keyvals []interface{}) {
+	if level > l.level {
+		return
+	}
+	if len(l.keyvals) > 0 {
+		keyvals = append(append([]interface{}{}, l.keyvals...), keyvals...)
+	}
+	l.formatter.Format(l.w, level, msg, keyvals)
 }
 
-// Sets the level and formatter on the log, which must be a DefaultLogger.
-func setLevelFormatter(logger log.Logger, level int, formatter log.Formatter) log.Logger {
-	logger.(*log.DefaultLogger).SetLevel(level)
-	logger.(*log.DefaultLogger).SetFormatter(formatter)
-	return logger
+// logFatal logs msg at the error level, then panics. It's used where the
+// server can't safely continue, typically because its storage failed.
+func logFatal(logger Logger, msg string, keyvals ...interface{}) {
+	logger.Error(msg, keyvals...)
+	panic(fmt.Sprintf("%v: %v", msg, keyvals))
 }
 
 // createRaftFormatter builds a formatter and looks via environment variables
 // for style customization.
-func createRaftFormatter(tag string, withLine bool) log.Formatter {
+func createRaftFormatter(tag string, withLine bool) *raftFormatter {
 	ret := &raftFormatter{
 		tag:      tag,
 		withLine: withLine,
@@ -108,18 +173,14 @@ func (v *raftFormatter) formatDefault(writer io.Writer, level int, msg string, a
 	writer.Write([]byte(time.Now().Local().Format("2006/01/02 15:04:05.000000")))
 
 	switch level {
-	case log.LevelCritical:
-		writer.Write([]byte(" [CRIT ] "))
-	case log.LevelError:
+	case LogLevelError:
 		writer.Write([]byte(" [ERROR] "))
-	case log.LevelWarn:
+	case LogLevelWarn:
 		writer.Write([]byte(" [WARN ] "))
-	case log.LevelInfo:
+	case LogLevelInfo:
 		writer.Write([]byte(" [INFO ] "))
-	case log.LevelDebug:
+	case LogLevelDebug:
 		writer.Write([]byte(" [DEBUG] "))
-	case log.LevelTrace:
-		writer.Write([]byte(" [TRACE] "))
 	default:
 		writer.Write([]byte(" [ALL  ] "))
 	}
@@ -132,6 +193,8 @@ func (v *raftFormatter) formatDefault(writer io.Writer, level int, msg string, a
 
 	// This is a little jank, but it's only used during unit tests.
 	if v.withLine {
+		// Skip over frames in this file, wherever the package is checked out.
+		_, self, _, _ := runtime.Caller(0)
 		file := "???"
 		line := 0
 		depth := 0
@@ -139,8 +202,7 @@ func (v *raftFormatter) formatDefault(writer io.Writer, level int, msg string, a
 			var ok bool
 			_, file, line, ok = runtime.Caller(depth)
 			if ok {
-				if strings.Contains(file, "/logxi/") ||
-					strings.HasSuffix(file, "/raft/logger.go") {
+				if file == self {
 					depth++
 					continue
 				}
@@ -183,18 +245,14 @@ func (v *raftFormatter) formatJSON(writer io.Writer, level int, msg string, args
 
 	var levelStr string
 	switch level {
-	case log.LevelCritical:
-		levelStr = "critical"
-	case log.LevelError:
+	case LogLevelError:
 		levelStr = "error"
-	case log.LevelWarn:
+	case LogLevelWarn:
 		levelStr = "warn"
-	case log.LevelInfo:
+	case LogLevelInfo:
 		levelStr = "info"
-	case log.LevelDebug:
+	case LogLevelDebug:
 		levelStr = "debug"
-	case log.LevelTrace:
-		levelStr = "trace"
 	default:
 		levelStr = "all"
 	}
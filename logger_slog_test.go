@@ -0,0 +1,25 @@
+//go:build go1.21
+
+package raft
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Slog(t *testing.T) {
+	dest := bytes.Buffer{}
+	handler := slog.NewTextHandler(&dest, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logger := NewSlogLogger(slog.New(handler)).With("id", "server1")
+	logger.Debug("hidden")
+	logger.Error("failed", "error", "boom")
+	out := dest.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("Debug message not expected at Info level: %q", out)
+	}
+	if !strings.Contains(out, `level=ERROR msg=failed id=server1 error=boom`) {
+		t.Errorf("Log message in wrong format: %q", out)
+	}
+}
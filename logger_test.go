@@ -36,3 +36,17 @@ func TestLogger_LogLevel(t *testing.T) {
 		t.Errorf("Log message at ERROR level expected to be in log, but couldn't find it: %q", dest.String())
 	}
 }
+
+func TestLogger_With(t *testing.T) {
+	dest := bytes.Buffer{}
+	logger := DefaultStdLogger(&dest).With("id", "server1")
+	logger.With("peer", "server2").Warn("scoped", "index", 5)
+	if !strings.Contains(dest.String(), "[WARN ] scoped: id=server1 peer=server2 index=5") {
+		t.Errorf("Log message missing scoped fields: %q", dest.String())
+	}
+	dest.Reset()
+	logger.Info("unscoped")
+	if strings.Contains(dest.String(), "peer=") {
+		t.Errorf("With leaked fields into its parent: %q", dest.String())
+	}
+}
@@ -10,6 +10,12 @@ import (
 // configuration, which is a set of servers, each of which is either a Voter,
 // Nonvoter, or Staging (defined below).
 //
+// Changes to several servers at once use joint consensus instead, also
+// described in the dissertation. The leader first appends a joint
+// configuration holding both the old and the new set of servers, in which
+// elections and commitment need majorities of the voters in each. Once that
+// has committed, it appends the new configuration on its own.
+//
 // All changes to the membership configuration is done by writing a new
 // membership configuration to the log, which the server does in
 // appendMembershipEntry(). The new configuration will be in affect as soon as
@@ -78,6 +84,10 @@ type Server struct {
 	ID ServerID
 	// Address is its network address that a transport can contact.
 	Address ServerAddress
+	// Metadata holds optional labels for the server, such as its zone, rack or
+	// version. Raft replicates it with the rest of the membership but doesn't
+	// interpret it. It needs protocol version 6; older servers drop it.
+	Metadata map[string]string
 }
 
 // Configuration tracks which servers are in the cluster, and whether they have
@@ -86,23 +96,109 @@ type Server struct {
 // These entries are appended to the log during membership changes.
 type Membership struct {
 	Servers []Server
+	// OldServers is only set in the joint configuration of a change made
+	// with ChangeMembership. It then holds the servers being replaced, while
+	// Servers holds their replacements.
+	OldServers []Server
 }
 
 func (m Membership) String() string {
-	vec := make([]string, 0, len(m.Servers))
-	for _, server := range m.Servers {
-		vec = append(vec, fmt.Sprintf("%s at %s (%s)",
-			server.ID, server.Address, server.Suffrage))
+	format := func(servers []Server) string {
+		vec := make([]string, 0, len(servers))
+		for _, server := range servers {
+			vec = append(vec, fmt.Sprintf("%s at %s (%s)",
+				server.ID, server.Address, server.Suffrage))
+		}
+		return fmt.Sprintf("[%s]", strings.Join(vec, ", "))
 	}
-	return fmt.Sprintf("[%s]", strings.Join(vec, ", "))
+	if m.joint() {
+		return fmt.Sprintf("%s (joint with %s)", format(m.Servers), format(m.OldServers))
+	}
+	return format(m.Servers)
 }
 
 // Clone makes a deep copy of a Membership.
 func (m *Membership) Clone() (copy Membership) {
-	copy.Servers = append(copy.Servers, m.Servers...)
+	copy.Servers = cloneServers(m.Servers)
+	copy.OldServers = cloneServers(m.OldServers)
+	return
+}
+
+// cloneServers makes a deep copy of a list of servers, including their
+// metadata.
+func cloneServers(servers []Server) (copy []Server) {
+	for _, server := range servers {
+		server.Metadata = cloneMetadata(server.Metadata)
+		copy = append(copy, server)
+	}
 	return
 }
 
+// cloneMetadata makes a copy of a server's metadata.
+func cloneMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copy := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copy[k] = v
+	}
+	return copy
+}
+
+// joint returns true if m is the joint configuration of a change made with
+// ChangeMembership.
+func (m Membership) joint() bool {
+	return len(m.OldServers) > 0
+}
+
+// allServers returns every server in m, including the old ones in a joint
+// configuration. A server in both sets appears once, as in Servers, but is a
+// Voter if it has a vote in either.
+func (m Membership) allServers() []Server {
+	if !m.joint() {
+		return m.Servers
+	}
+	servers := append([]Server(nil), m.Servers...)
+	index := make(map[ServerID]int, len(servers))
+	for i, server := range servers {
+		index[server.ID] = i
+	}
+	for _, server := range m.OldServers {
+		if i, ok := index[server.ID]; ok {
+			if server.Suffrage == Voter {
+				servers[i].Suffrage = Voter
+			}
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// quorumGeq returns the largest value that a majority of the voters in m
+// have reached, given the values of some servers; missing ones count as 0.
+// In a joint configuration, the majority is needed among both the new and
+// the old voters.
+func (m Membership) quorumGeq(values map[ServerID]uint64) uint64 {
+	voterValues := func(servers []Server) []uint64 {
+		var out []uint64
+		for _, server := range servers {
+			if server.Suffrage == Voter {
+				out = append(out, values[server.ID])
+			}
+		}
+		return out
+	}
+	geq := quorumGeq(voterValues(m.Servers))
+	if m.joint() {
+		if old := quorumGeq(voterValues(m.OldServers)); old < geq {
+			geq = old
+		}
+	}
+	return geq
+}
+
 // MembershipChangeCommand is the different ways to change the cluster
 // configuration, as illustrated in the following diagram:
 //
@@ -123,6 +219,9 @@ func (m *Membership) Clone() (copy Membership) {
 //                         \                                /
 //                          `--------------<---------------'
 //
+// UpdateAddress, EnterJoint and LeaveJoint aren't shown: UpdateAddress leaves a
+// server in the same state, and the joint commands replace every server at once.
+//
 // Note that these are the internal commands the leader places in the log, which
 // differ from client requests when adding voters. Specifically, when clients
 // request AddVoter, the leader will append an AddStaging command. Once the
@@ -141,6 +240,15 @@ const (
 	// Promote is created automatically by a leader; it turns a Staging server
 	// into a Voter.
 	Promote
+	// EnterJoint replaces all the servers at once, by moving to the joint
+	// configuration of the old and new servers. It's used by
+	// ChangeMembership.
+	EnterJoint
+	// LeaveJoint is created automatically by a leader once a joint
+	// configuration has committed; it drops the old servers.
+	LeaveJoint
+	// UpdateAddress changes the address of a server, keeping its suffrage.
+	UpdateAddress
 )
 
 func (m MembershipChangeCommand) String() string {
@@ -155,6 +263,12 @@ func (m MembershipChangeCommand) String() string {
 		return "RemoveServer"
 	case Promote:
 		return "Promote"
+	case EnterJoint:
+		return "EnterJoint"
+	case LeaveJoint:
+		return "LeaveJoint"
+	case UpdateAddress:
+		return "UpdateAddress"
 	}
 	return "MembershipChangeCommand"
 }
@@ -166,11 +280,32 @@ func (m MembershipChangeCommand) String() string {
 type membershipChangeRequest struct {
 	command       MembershipChangeCommand
 	serverID      ServerID
-	serverAddress ServerAddress // only present for AddStaging, AddNonvoter
+	serverAddress ServerAddress // only present for AddStaging, AddNonvoter, UpdateAddress
+	servers       []Server      // only present for EnterJoint
+	// serverMetadata, if non-nil, replaces the server's metadata. It's only
+	// present for AddStaging and AddNonvoter.
+	serverMetadata map[string]string
 	// prevIndex, if nonzero, is the index of the only configuration upon which
 	// this change may be applied; if another configuration entry has been
 	// added in the meantime, this request will fail.
 	prevIndex Index
+	// localID is the server making the change, filled in by the leader.
+	// UpdateAddress may not change its address, since a server can't move
+	// itself while it's running.
+	localID ServerID
+}
+
+// hasMetadata returns true if the request sets metadata on any server.
+func (change *membershipChangeRequest) hasMetadata() bool {
+	if len(change.serverMetadata) > 0 {
+		return true
+	}
+	for _, server := range change.servers {
+		if len(server.Metadata) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // memberships is state tracked on every server about its Cluster Membership.
@@ -209,9 +344,9 @@ func (m *memberships) Clone() (copy memberships) {
 }
 
 // hasVote returns true if the server identified by 'id' is a Voter in the
-// provided Membership.
+// provided Membership, or in its old servers if it's a joint configuration.
 func hasVote(membership Membership, id ServerID) bool {
-	for _, server := range membership.Servers {
+	for _, server := range membership.allServers() {
 		if server.ID == id {
 			return server.Suffrage == Voter
 		}
@@ -256,6 +391,9 @@ func nextMembership(current Membership, currentIndex Index, change membershipCha
 	if change.prevIndex > 0 && change.prevIndex != currentIndex {
 		return Membership{}, fmt.Errorf("Membership changed since %v (latest is %v)", change.prevIndex, currentIndex)
 	}
+	if current.joint() && change.command != LeaveJoint {
+		return Membership{}, fmt.Errorf("Joint membership change in progress")
+	}
 
 	membership := current.Clone()
 	switch change.command {
@@ -270,6 +408,7 @@ func nextMembership(current Membership, currentIndex Index, change membershipCha
 			Suffrage: Voter,
 			ID:       change.serverID,
 			Address:  change.serverAddress,
+			Metadata: cloneMetadata(change.serverMetadata),
 		}
 		found := false
 		for i, server := range membership.Servers {
@@ -279,6 +418,9 @@ func nextMembership(current Membership, currentIndex Index, change membershipCha
 						server.ID, server.Address, change.serverAddress)
 				}
 				membership.Servers[i].Suffrage = Voter
+				if change.serverMetadata != nil {
+					membership.Servers[i].Metadata = newServer.Metadata
+				}
 				found = true
 				break
 			}
@@ -291,14 +433,18 @@ func nextMembership(current Membership, currentIndex Index, change membershipCha
 			Suffrage: Nonvoter,
 			ID:       change.serverID,
 			Address:  change.serverAddress,
+			Metadata: cloneMetadata(change.serverMetadata),
 		}
 		found := false
-		for _, server := range membership.Servers {
+		for i, server := range membership.Servers {
 			if server.ID == change.serverID {
 				if server.Address != change.serverAddress {
 					return Membership{}, fmt.Errorf("May not change address of server %v (was %v, given %v)",
 						server.ID, server.Address, change.serverAddress)
 				}
+				if change.serverMetadata != nil {
+					membership.Servers[i].Metadata = newServer.Metadata
+				}
 				found = true
 				break
 			}
@@ -327,6 +473,39 @@ func nextMembership(current Membership, currentIndex Index, change membershipCha
 				break
 			}
 		}
+	case EnterJoint:
+		for _, server := range change.servers {
+			for _, old := range current.Servers {
+				if server.ID == old.ID && server.Address != old.Address {
+					return Membership{}, fmt.Errorf("May not change address of server %v (was %v, given %v)",
+						server.ID, old.Address, server.Address)
+				}
+			}
+		}
+		membership = Membership{
+			Servers:    cloneServers(change.servers),
+			OldServers: membership.Servers,
+		}
+	case LeaveJoint:
+		if !current.joint() {
+			return Membership{}, fmt.Errorf("No joint membership change in progress")
+		}
+		membership.OldServers = nil
+	case UpdateAddress:
+		found := false
+		for i, server := range membership.Servers {
+			if server.ID == change.serverID {
+				if server.ID == change.localID && server.Address != change.serverAddress {
+					return Membership{}, fmt.Errorf("Can't change the address of the local server %v", server.ID)
+				}
+				membership.Servers[i].Address = change.serverAddress
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Membership{}, fmt.Errorf("Server %v is not in the membership", change.serverID)
+		}
 	}
 
 	// Make sure we didn't do something bad like remove the last voter
@@ -18,6 +18,7 @@ var sampleMembership Membership = Membership{
 			Suffrage: Voter,
 			ID:       ServerID("id1"),
 			Address:  ServerAddress("addr1"),
+			Metadata: map[string]string{"zone": "zone1"},
 		},
 		Server{
 			Suffrage: Staging,
@@ -36,6 +37,10 @@ func TestMembership_Membership_Clone(t *testing.T) {
 	if sampleMembership.Servers[1].ID == "scribble" {
 		t.Fatalf("cloned configuration shouldn't alias Servers")
 	}
+	cloned.Servers[1].Metadata["zone"] = "scribble"
+	if sampleMembership.Servers[1].Metadata["zone"] == "scribble" {
+		t.Fatalf("cloned configuration shouldn't alias Metadata")
+	}
 }
 
 func TestMembership_Memberships_Clone(t *testing.T) {
@@ -307,6 +312,186 @@ func TestMembership_nextMembership_checkMembership(t *testing.T) {
 	}
 }
 
+func TestMembership_nextMembership_joint(t *testing.T) {
+	req := membershipChangeRequest{
+		command: EnterJoint,
+		servers: []Server{
+			{Suffrage: Voter, ID: "id2", Address: "addr2"},
+			{Suffrage: Voter, ID: "id3", Address: "addr3"},
+		},
+	}
+	joint, err := nextMembership(voterPair, 1, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := "[id2 at addr2 (Voter), id3 at addr3 (Voter)] (joint with [id1 at addr1 (Voter), id2 at addr2 (Voter)])"
+	if joint.String() != expect {
+		t.Fatalf("nextMembership returned %v, expected %s", joint, expect)
+	}
+
+	// Nothing else may change until the joint configuration is left.
+	_, err = nextMembership(joint, 2, req)
+	if err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("nextMembership should have failed during a joint change, got %v", err)
+	}
+	_, err = nextMembership(joint, 2, membershipChangeRequest{command: RemoveServer, serverID: "id3"})
+	if err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("nextMembership should have failed during a joint change, got %v", err)
+	}
+	next, err := nextMembership(joint, 2, membershipChangeRequest{command: LeaveJoint})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if next.String() != "[id2 at addr2 (Voter), id3 at addr3 (Voter)]" {
+		t.Fatalf("nextMembership returned %v", next)
+	}
+	_, err = nextMembership(next, 3, membershipChangeRequest{command: LeaveJoint})
+	if err == nil {
+		t.Fatalf("nextMembership should have failed without a joint change")
+	}
+
+	// Addresses can't change along the way.
+	req.servers[0].Address = "addr2x"
+	_, err = nextMembership(voterPair, 1, req)
+	if err == nil || !strings.Contains(err.Error(), "May not change address") {
+		t.Fatalf("nextMembership should have failed for attempting to change address")
+	}
+}
+
+func TestMembership_nextMembership_updateAddress(t *testing.T) {
+	req := membershipChangeRequest{
+		command:       UpdateAddress,
+		serverID:      ServerID("id2"),
+		serverAddress: ServerAddress("addr2x"),
+	}
+	next, err := nextMembership(oneOfEach, 1, req)
+	if err != nil {
+		t.Fatalf("nextMembership should have succeeded, got %v", err)
+	}
+	expect := "[id1 at addr1 (Voter), id2 at addr2x (Staging), id3 at addr3 (Nonvoter)]"
+	if next.String() != expect {
+		t.Fatalf("nextMembership returned %v, expected %s", next, expect)
+	}
+
+	// Unknown server.
+	req.serverID = ServerID("id4")
+	_, err = nextMembership(oneOfEach, 1, req)
+	if err == nil || !strings.Contains(err.Error(), "not in the membership") {
+		t.Fatalf("nextMembership should have failed for an unknown server, got %v", err)
+	}
+
+	// Address already in use.
+	req.serverID = ServerID("id2")
+	req.serverAddress = ServerAddress("addr3")
+	_, err = nextMembership(oneOfEach, 1, req)
+	if err == nil || !strings.Contains(err.Error(), "duplicate address") {
+		t.Fatalf("nextMembership should have failed for a duplicate address, got %v", err)
+	}
+
+	// The local server can't move.
+	req.serverAddress = ServerAddress("addr2x")
+	req.localID = ServerID("id2")
+	_, err = nextMembership(oneOfEach, 1, req)
+	if err == nil || !strings.Contains(err.Error(), "local server") {
+		t.Fatalf("nextMembership should have failed for the local server, got %v", err)
+	}
+	req.serverAddress = ServerAddress("addr2")
+	if _, err = nextMembership(oneOfEach, 1, req); err != nil {
+		t.Fatalf("nextMembership should allow the local server's current address, got %v", err)
+	}
+}
+
+func TestMembership_nextMembership_metadata(t *testing.T) {
+	// New servers get the metadata.
+	req := membershipChangeRequest{
+		command:        AddNonvoter,
+		serverID:       ServerID("id2"),
+		serverAddress:  ServerAddress("addr2"),
+		serverMetadata: map[string]string{"zone": "zone2"},
+	}
+	if !req.hasMetadata() {
+		t.Fatalf("request should have metadata")
+	}
+	next, err := nextMembership(singleServer, 1, req)
+	if err != nil {
+		t.Fatalf("nextMembership should have succeeded, got %v", err)
+	}
+	if zone := next.Servers[1].Metadata["zone"]; zone != "zone2" {
+		t.Fatalf("bad zone %q", zone)
+	}
+
+	// Existing servers have it replaced, whatever their suffrage.
+	req.command = AddStaging
+	req.serverMetadata = map[string]string{"zone": "zone3"}
+	next, err = nextMembership(next, 2, req)
+	if err != nil {
+		t.Fatalf("nextMembership should have succeeded, got %v", err)
+	}
+	if next.Servers[1].Suffrage != Voter || next.Servers[1].Metadata["zone"] != "zone3" {
+		t.Fatalf("bad server %+v", next.Servers[1])
+	}
+
+	// Nil metadata leaves it alone, as do other commands.
+	req.serverMetadata = nil
+	if req.hasMetadata() {
+		t.Fatalf("request shouldn't have metadata")
+	}
+	next, err = nextMembership(next, 3, req)
+	if err != nil {
+		t.Fatalf("nextMembership should have succeeded, got %v", err)
+	}
+	next, err = nextMembership(next, 4, membershipChangeRequest{
+		command:       UpdateAddress,
+		serverID:      ServerID("id2"),
+		serverAddress: ServerAddress("addr2x"),
+	})
+	if err != nil {
+		t.Fatalf("nextMembership should have succeeded, got %v", err)
+	}
+	if zone := next.Servers[1].Metadata["zone"]; zone != "zone3" {
+		t.Fatalf("bad zone %q", zone)
+	}
+}
+
+func TestMembership_quorumGeq_joint(t *testing.T) {
+	joint := Membership{
+		Servers: []Server{
+			{Suffrage: Voter, ID: "id3", Address: "addr3"},
+			{Suffrage: Voter, ID: "id4", Address: "addr4"},
+			{Suffrage: Voter, ID: "id5", Address: "addr5"},
+			{Suffrage: Nonvoter, ID: "id1", Address: "addr1"},
+		},
+		OldServers: []Server{
+			{Suffrage: Voter, ID: "id1", Address: "addr1"},
+			{Suffrage: Voter, ID: "id2", Address: "addr2"},
+			{Suffrage: Voter, ID: "id3", Address: "addr3"},
+		},
+	}
+	if !hasVote(joint, "id1") || !hasVote(joint, "id2") || !hasVote(joint, "id5") {
+		t.Fatalf("voters in either configuration should have a vote")
+	}
+	if servers := joint.allServers(); len(servers) != 5 || servers[3].Suffrage != Voter {
+		t.Fatalf("bad servers: %v", servers)
+	}
+
+	// A majority of the new voters isn't enough on its own.
+	if geq := joint.quorumGeq(map[ServerID]uint64{"id3": 5, "id4": 5, "id5": 5}); geq != 0 {
+		t.Fatalf("expected 0, got %d", geq)
+	}
+	// Nor is a majority of the old ones.
+	if geq := joint.quorumGeq(map[ServerID]uint64{"id1": 5, "id2": 5}); geq != 0 {
+		t.Fatalf("expected 0, got %d", geq)
+	}
+	// Both together are.
+	values := map[ServerID]uint64{"id1": 9, "id2": 7, "id3": 5, "id4": 6}
+	if geq := joint.quorumGeq(values); geq != 5 {
+		t.Fatalf("expected 5, got %d", geq)
+	}
+	if geq := voterPair.quorumGeq(values); geq != 7 {
+		t.Fatalf("expected 7, got %d", geq)
+	}
+}
+
 func TestMembership_encodeDecodePeers(t *testing.T) {
 	// Set up membership.
 	var membership Membership
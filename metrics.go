@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// Metrics receives the counters, gauges and timings emitted by a Raft server.
+// Keys are paths such as []string{"raft", "fsm", "apply"}. Implementations
+// must be safe for concurrent use. Set Config.Metrics to give each Raft server
+// in a process its own metrics.
+type Metrics interface {
+	// IncrCounter adds val to a counter.
+	IncrCounter(key []string, val float32, labels ...metrics.Label)
+
+	// SetGauge sets a gauge to val.
+	SetGauge(key []string, val float32, labels ...metrics.Label)
+
+	// AddSample records one observation of a distribution.
+	AddSample(key []string, val float32, labels ...metrics.Label)
+
+	// MeasureSince records the time elapsed since start, in milliseconds.
+	MeasureSince(key []string, start time.Time, labels ...metrics.Label)
+}
+
+// GlobalMetrics sends metrics to the armon/go-metrics global functions. It's
+// used when Config.Metrics is nil.
+type GlobalMetrics struct{}
+
+// IncrCounter is part of Metrics.
+func (GlobalMetrics) IncrCounter(key []string, val float32, labels ...metrics.Label) {
+	if len(labels) == 0 {
+		metrics.IncrCounter(key, val)
+	} else {
+		metrics.IncrCounterWithLabels(key, val, labels)
+	}
+}
+
+// SetGauge is part of Metrics.
+func (GlobalMetrics) SetGauge(key []string, val float32, labels ...metrics.Label) {
+	if len(labels) == 0 {
+		metrics.SetGauge(key, val)
+	} else {
+		metrics.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+// AddSample is part of Metrics.
+func (GlobalMetrics) AddSample(key []string, val float32, labels ...metrics.Label) {
+	if len(labels) == 0 {
+		metrics.AddSample(key, val)
+	} else {
+		metrics.AddSampleWithLabels(key, val, labels)
+	}
+}
+
+// MeasureSince is part of Metrics.
+func (GlobalMetrics) MeasureSince(key []string, start time.Time, labels ...metrics.Label) {
+	if len(labels) == 0 {
+		metrics.MeasureSince(key, start)
+	} else {
+		metrics.MeasureSinceWithLabels(key, start, labels)
+	}
+}
+
+// SinkMetrics sends metrics directly to a go-metrics MetricSink, bypassing
+// the go-metrics globals.
+type SinkMetrics struct {
+	Sink metrics.MetricSink
+}
+
+// IncrCounter is part of Metrics.
+func (m SinkMetrics) IncrCounter(key []string, val float32, labels ...metrics.Label) {
+	m.Sink.IncrCounterWithLabels(key, val, labels)
+}
+
+// SetGauge is part of Metrics.
+func (m SinkMetrics) SetGauge(key []string, val float32, labels ...metrics.Label) {
+	m.Sink.SetGaugeWithLabels(key, val, labels)
+}
+
+// AddSample is part of Metrics.
+func (m SinkMetrics) AddSample(key []string, val float32, labels ...metrics.Label) {
+	m.Sink.AddSampleWithLabels(key, val, labels)
+}
+
+// MeasureSince is part of Metrics.
+func (m SinkMetrics) MeasureSince(key []string, start time.Time, labels ...metrics.Label) {
+	elapsed := time.Since(start)
+	msec := float32(elapsed.Nanoseconds()) / float32(time.Millisecond)
+	m.Sink.AddSampleWithLabels(key, msec, labels)
+}
@@ -11,13 +11,14 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-msgpack/codec"
-	log "github.com/mgutz/logxi/v1"
 )
 
 const (
 	rpcAppendEntries uint8 = iota
 	rpcRequestVote
 	rpcInstallSnapshot
+	rpcTimeoutNow
+	rpcReadIndex
 
 	// DefaultTimeoutScale is the default TimeoutScale in a NetworkTransport.
 	DefaultTimeoutScale = 256 * 1024 // 256KB
@@ -64,7 +65,7 @@ type NetworkTransport struct {
 	heartbeatFn     func(RPC)
 	heartbeatFnLock sync.Mutex
 
-	logger log.Logger
+	logger Logger
 
 	maxPool int
 
@@ -135,7 +136,7 @@ func NewNetworkTransportWithLogger(
 	stream StreamLayer,
 	maxPool int,
 	timeout time.Duration,
-	logger log.Logger,
+	logger Logger,
 ) *NetworkTransport {
 	if logger == nil {
 		logger = DefaultStdLogger(os.Stderr)
@@ -280,6 +281,16 @@ func (n *NetworkTransport) RequestVote(target ServerAddress, args *RequestVoteRe
 	return n.genericRPC(target, rpcRequestVote, args, resp)
 }
 
+// TimeoutNow implements the Transport interface.
+func (n *NetworkTransport) TimeoutNow(target ServerAddress, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	return n.genericRPC(target, rpcTimeoutNow, args, resp)
+}
+
+// ReadIndex implements the Transport interface.
+func (n *NetworkTransport) ReadIndex(target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error {
+	return n.genericRPC(target, rpcReadIndex, args, resp)
+}
+
 // genericRPC handles a simple request/response RPC.
 func (n *NetworkTransport) genericRPC(target ServerAddress, rpcType uint8, args interface{}, resp interface{}) error {
 	// Get a conn
@@ -443,6 +454,20 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 		rpc.Command = &req
 		rpc.Reader = io.LimitReader(r, req.Size)
 
+	case rpcTimeoutNow:
+		var req TimeoutNowRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+
+	case rpcReadIndex:
+		var req ReadIndexRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+
 	default:
 		return fmt.Errorf("unknown rpc type %d", rpcType)
 	}
@@ -5,10 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
-
-	"github.com/armon/go-metrics"
-	log "github.com/mgutz/logxi/v1"
 )
 
 // Settings controlling Peer behavior, as passed to startPeer().
@@ -31,6 +29,13 @@ type peerOptions struct {
 
 	// Maximum amount to wait after many transport errors before retrying.
 	maxFailureWait time.Duration
+
+	// If set, used to tell observers when RPCs to the peer start failing and
+	// when they resume, while leader.
+	observe func(o interface{})
+
+	// Receives replication metrics. Defaults to GlobalMetrics.
+	metrics Metrics
 }
 
 // This struct is accessed concurrently by different Peer goroutines.
@@ -39,7 +44,7 @@ type peerShared struct {
 	options peerOptions
 
 	// Where to print debug messages.
-	logger log.Logger
+	logger Logger
 
 	// Used to spawn goroutines so others can wait on their exit.
 	goRoutines *waitGroup
@@ -67,9 +72,6 @@ type peerShared struct {
 	// Network address of the remote server (constant).
 	peerAddr ServerAddress
 
-	// Version number sent in request headers (constant).
-	protocolVersion ProtocolVersion
-
 	// Helper goroutines send fully prepared RPC requests onto requestCh.
 	// The main Peer goroutine validates each request against the latest
 	// control information, then spawns another goroutine to send it.
@@ -122,6 +124,21 @@ type peerControl struct {
 
 	// The last entry committed in the log (this may be past lastIndex).
 	commitIndex Index
+
+	// As candidate, set if this election was started by a leadership transfer,
+	// so that RequestVote asks the peer to disregard its current leader. As
+	// leader, set if this peer is the target of a leadership transfer, so that
+	// it's sent a TimeoutNow RPC once it has caught up to lastIndex.
+	leadershipTransfer bool
+
+	// As candidate, set while running a pre-vote round. RequestVote then asks
+	// whether the peer would vote for this server in term+1, without either
+	// server changing its term or persisting a vote.
+	preVote bool
+
+	// The version of the protocol to speak in requests. A leader may change
+	// this as it learns which versions its peers understand.
+	protocolVersion ProtocolVersion
 }
 
 // This Peer sends this struct to the raft.go module to inform it of newly
@@ -139,6 +156,10 @@ type peerProgress struct {
 	// Set to true if the peer granted this server a vote in 'term'.
 	voteGranted bool
 
+	// Set to true if the peer said it would vote for this server in the
+	// current pre-vote round. Reset whenever a new candidate round starts.
+	preVoteGranted bool
+
 	// The index in the log that the remote server has acknowledged as matching
 	// this server's. Reset to 0 when the term changes.
 	matchIndex Index
@@ -161,6 +182,18 @@ type peerProgress struct {
 	// The value of control.verifyCounter when the last completed heartbeat to the
 	// peer was sent.
 	verifiedCounter uint64
+
+	// The index of the next log entry the leader will send to the peer. Only
+	// meaningful while leader; reported for Stats.
+	nextIndex Index
+
+	// Set while an InstallSnapshot RPC to the peer is outstanding. Only
+	// meaningful while leader; reported for Stats.
+	installingSnapshot bool
+
+	// The newest protocol version the peer said it understands in its last
+	// reply, or 0 if it hasn't replied or has since rejected our version.
+	protocolVersionMax ProtocolVersion
 }
 
 // Private state to the peer that is used while this server is a Candidate.
@@ -218,6 +251,13 @@ type peerLeaderState struct {
 	// AppendEntries pipeline during control.term, then cleared when the pipeline
 	// is ready for more.
 	outstandingPipelineSend bool
+
+	// Set to true while a TimeoutNow RPC is in progress during control.term.
+	outstandingTimeoutNow bool
+
+	// Set to true once the peer has acknowledged a TimeoutNow RPC for the
+	// current leadership transfer. Cleared when control.leadershipTransfer is.
+	timeoutNowSent bool
 }
 
 // The main type of a Peer (peer clashes too much), which is in charge of all
@@ -269,23 +309,26 @@ type peerState struct {
 	// If failures is nonzero, RequestVote, bulk (non-heartbet) AppendEntries, and
 	// InstallSnapshot are not sent until this timer elapses.
 	backoffTimer *time.Timer
+
+	// Set once a FailedHeartbeatObservation has been sent, until an RPC
+	// succeeds again. Unlike failures, this survives the backoff timer.
+	unreachable bool
 }
 
 // startPeer is the normal way for peers to be created.
 func startPeer(serverID ServerID,
 	serverAddress ServerAddress,
-	logger log.Logger,
+	logger Logger,
 	logs LogStore,
 	snapshots SnapshotStore,
 	goRoutines *waitGroup,
 	trans Transport,
 	localAddr ServerAddress,
-	protocolVersion ProtocolVersion,
 	progressCh chan<- peerProgress,
 	options peerOptions) chan<- peerControl {
 	controlCh := make(chan peerControl)
 	p := makePeerInternal(serverID, serverAddress, logger, logs, snapshots,
-		goRoutines, trans, localAddr, protocolVersion, controlCh, progressCh, options)
+		goRoutines, trans, localAddr, controlCh, progressCh, options)
 	p.shared.goRoutines.spawn(p.selectLoop)
 	return controlCh
 }
@@ -293,13 +336,12 @@ func startPeer(serverID ServerID,
 // makePeerInternal is used for unit tests. Everyone else should use startPeer.
 func makePeerInternal(serverID ServerID,
 	serverAddress ServerAddress,
-	logger log.Logger,
+	logger Logger,
 	logs LogStore,
 	snapshots SnapshotStore,
 	goRoutines *waitGroup,
 	trans Transport,
 	localAddr ServerAddress,
-	protocolVersion ProtocolVersion,
 	controlCh <-chan peerControl,
 	progressCh chan<- peerProgress,
 	options peerOptions) *peerState {
@@ -316,6 +358,9 @@ func makePeerInternal(serverID ServerID,
 	if options.failureWait == 0 {
 		options.failureWait = 10 * time.Millisecond
 	}
+	if options.metrics == nil {
+		options.metrics = GlobalMetrics{}
+	}
 	if options.maxFailureWait == 0 {
 		options.maxFailureWait = 100 * time.Millisecond
 	}
@@ -330,7 +375,6 @@ func makePeerInternal(serverID ServerID,
 			peerAddr:           serverAddress,
 			trans:              trans,
 			localAddr:          localAddr,
-			protocolVersion:    protocolVersion,
 			logger:             logger,
 			logs:               logs,
 			snapshots:          snapshots,
@@ -432,6 +476,7 @@ func (p *peerState) blockingSelect() {
 
 	var progressChIfDirty chan<- peerProgress
 	if p.sendProgress {
+		p.updateLeaderProgress()
 		progressChIfDirty = p.progressCh
 	}
 
@@ -469,6 +514,10 @@ func (p *peerState) updateControl(latest peerControl) {
 	if latest.role == Candidate {
 		if p.candidate == nil {
 			p.candidate = &peerCandidateState{}
+			if p.progress.preVoteGranted {
+				p.progress.preVoteGranted = false
+				p.sendProgress = true
+			}
 		}
 	} else {
 		p.candidate = nil
@@ -484,6 +533,9 @@ func (p *peerState) updateControl(latest peerControl) {
 				allowPipeline:     false,
 			}
 		}
+		if !latest.leadershipTransfer {
+			p.leader.timeoutNowSent = false
+		}
 	} else {
 		p.leader = nil
 	}
@@ -491,13 +543,27 @@ func (p *peerState) updateControl(latest peerControl) {
 	p.control = latest
 }
 
+// updateLeaderProgress copies the leader replication state that's reported in
+// Stats into p.progress. This piggybacks on progress updates that are sent
+// anyway (at least once per heartbeat) rather than marking progress dirty.
+func (p *peerState) updateLeaderProgress() {
+	if p.leader != nil {
+		p.progress.nextIndex = p.leader.nextIndex
+		p.progress.installingSnapshot = p.leader.outstandingInstallSnapshotRPC
+	} else {
+		p.progress.nextIndex = 0
+		p.progress.installingSnapshot = false
+	}
+}
+
 // start creates a peerRPC object, then spawns a goroutine to prepare its
 // request and notify the peer's requestCh. It returns right away.
 func (p *peerState) start(makeRPC func(*peerState) peerRPC) {
 	p.activeRPCs++
 	rpc := makeRPC(p)
+	shared, control := p.shared, p.control
 	p.shared.goRoutines.spawn(func() {
-		startHelper(rpc, p.shared, p.control)
+		startHelper(rpc, shared, control)
 	})
 }
 
@@ -552,11 +618,29 @@ func (p *peerState) processReply(rpc peerRPC) {
 					"id", p.shared.peerID,
 					"address", p.shared.peerAddr)
 			}
+			if !p.unreachable && p.control.role == Leader &&
+				p.shared.options.observe != nil {
+				p.unreachable = true
+				p.shared.options.observe(FailedHeartbeatObservation{
+					PeerID:      p.shared.peerID,
+					LastContact: p.progress.lastContact,
+				})
+			}
 			p.failures++
 			p.backoffTimer.Reset(backoff(p.failures,
 				p.shared.options.failureWait,
 				p.shared.options.maxFailureWait))
 		}
+		// Match on the text rather than the error itself: NetworkTransport
+		// sends errors over the wire as strings, so the remote
+		// ErrUnsupportedProtocol arrives as a different error value.
+		if p.progress.protocolVersionMax > 0 &&
+			strings.Contains(rpc.err.Error(), ErrUnsupportedProtocol.Error()) {
+			// The peer no longer understands what we're speaking, perhaps
+			// because it was downgraded.
+			p.progress.protocolVersionMax = 0
+			p.sendProgress = true
+		}
 		rpc.orig.process(p, rpc.err)
 		p.activeRPCs--
 
@@ -569,6 +653,12 @@ func (p *peerState) processReply(rpc peerRPC) {
 			p.failures = 0
 			p.backoffTimer.Stop()
 		}
+		if p.unreachable {
+			p.unreachable = false
+			p.shared.options.observe(ResumedHeartbeatObservation{
+				PeerID: p.shared.peerID,
+			})
+		}
 		rpc.process(p, nil)
 		p.activeRPCs--
 		p.progress.lastContact = rpc.started()
@@ -608,6 +698,20 @@ func (p *peerState) issueWork() (didSomething bool) {
 			return true
 		}
 
+		// Send a TimeoutNow RPC. Used to hand off leadership to this peer once it
+		// has caught up with the end of the log.
+		if p.control.leadershipTransfer &&
+			!p.leader.outstandingTimeoutNow &&
+			!p.leader.timeoutNowSent &&
+			p.progress.matchIndex >= p.control.lastIndex &&
+			p.failures == 0 {
+			p.shared.logger.Info("Starting TimeoutNow RPC for peer",
+				"id", p.shared.peerID,
+				"address", p.shared.peerAddr)
+			p.start(makeTimeoutNowRPC)
+			return true
+		}
+
 		// Send an AppendEntries/InstallSnapshot RPC. Used to send the peer
 		// snapshots, entries, and inform it of new commit index values. This may
 		// block on the store or take a long time to transmit, so we don't want to
@@ -617,6 +721,10 @@ func (p *peerState) issueWork() (didSomething bool) {
 			p.failures == 0 &&
 			!p.leader.outstandingInstallSnapshotRPC {
 			if p.leader.needsSnapshot {
+				// Wait for any pipelined AppendEntries RPCs to drain first.
+				if p.leader.outstandingAppendEntriesRPCs > 0 {
+					return false
+				}
 				p.shared.logger.Info("Starting InstallSnapshot RPC for peer",
 					"id", p.shared.peerID,
 					"address", p.shared.peerAddr)
@@ -659,6 +767,12 @@ func updateTerm(progress *peerProgress, term Term) {
 	}
 }
 
+// updateProtocolVersion records the protocol versions the peer advertised in
+// a reply.
+func updateProtocolVersion(progress *peerProgress, header RPCHeader) {
+	progress.protocolVersionMax = header.versionMax()
+}
+
 // Every type of RPC sent to peers implements peerRPC. Some of its methods are
 // invoked on the main Peer goroutine and may not block. Others are run on
 // separate routines and may block. A typical RPC goes through the following
@@ -748,20 +862,30 @@ func (err *errorRPC) started() time.Time {
 
 type requestVoteRPC struct {
 	start time.Time
-	req   RequestVoteRequest
-	resp  RequestVoteResponse
+	// The value of control.term when the request was made. This differs from
+	// req.Term for pre-votes, which ask about the next term.
+	term Term
+	req  RequestVoteRequest
+	resp RequestVoteResponse
 }
 
 func makeRequestVoteRPC(p *peerState) peerRPC {
 	p.candidate.outstandingRequestVote = true
+	term := p.control.term
+	if p.control.preVote {
+		term++
+	}
 	return &requestVoteRPC{
 		start: time.Now(),
+		term:  p.control.term,
 		req: RequestVoteRequest{
-			RPCHeader:    RPCHeader{p.shared.protocolVersion},
-			Term:         p.control.term,
-			Candidate:    p.shared.trans.EncodePeer(p.shared.localAddr),
-			LastLogIndex: p.control.lastIndex,
-			LastLogTerm:  p.control.lastTerm,
+			RPCHeader:          makeRPCHeader(p.control.protocolVersion),
+			Term:               term,
+			Candidate:          p.shared.trans.EncodePeer(p.shared.localAddr),
+			LastLogIndex:       p.control.lastIndex,
+			LastLogTerm:        p.control.lastTerm,
+			LeadershipTransfer: p.control.leadershipTransfer,
+			PreVote:            p.control.preVote,
 		},
 	}
 }
@@ -775,18 +899,22 @@ func (rpc *requestVoteRPC) prepare(shared *peerShared, control peerControl) erro
 }
 
 func (rpc *requestVoteRPC) confirm(p *peerState) error {
-	if rpc.req.Term != p.control.term {
+	if rpc.term != p.control.term {
 		return errors.New("term changed, discarding RequestVote request")
 	}
 	if p.control.role != Candidate {
 		return errors.New("no longer candidate, discarding RequestVote request")
 	}
+	if rpc.req.PreVote != p.control.preVote {
+		return errors.New("pre-vote round ended, discarding RequestVote request")
+	}
 	return nil
 }
 
 func (rpc *requestVoteRPC) sendRecv(shared *peerShared) error {
 	shared.logger.Info("Sending RequestVote to peer",
 		"term", rpc.req.Term,
+		"pre_vote", rpc.req.PreVote,
 		"id", shared.peerID,
 		"address", shared.peerAddr)
 	err := shared.trans.RequestVote(shared.peerAddr, &rpc.req, &rpc.resp)
@@ -801,7 +929,7 @@ func (rpc *requestVoteRPC) sendRecv(shared *peerShared) error {
 
 func (rpc *requestVoteRPC) process(p *peerState, err error) {
 	// Update bookkeeping on outstanding RPCs.
-	if p.control.term == rpc.req.Term && p.control.role == Candidate {
+	if p.control.term == rpc.term && p.control.role == Candidate {
 		p.candidate.outstandingRequestVote = false
 	}
 
@@ -816,11 +944,28 @@ func (rpc *requestVoteRPC) process(p *peerState, err error) {
 
 	// Update progress and candidate state based on response.
 	updateTerm(&p.progress, rpc.resp.Term)
-	if p.control.term != rpc.req.Term || p.control.role != Candidate {
-		return // term or role changed locally
+	updateProtocolVersion(&p.progress, rpc.resp.RPCHeader)
+	if p.control.term != rpc.term || p.control.role != Candidate ||
+		p.control.preVote != rpc.req.PreVote {
+		return // term, role, or round changed locally
 	}
 	p.candidate.voteReplied = true
-	if rpc.req.Term == rpc.resp.Term {
+	if rpc.req.PreVote {
+		// The peer answers pre-votes with its own term, which is normally still
+		// behind the proposed one.
+		if rpc.resp.Granted && rpc.resp.PreVote {
+			p.progress.preVoteGranted = true
+			p.shared.logger.Info("Received pre-vote from peer",
+				"id", p.shared.peerID,
+				"address", p.shared.peerAddr,
+				"term", rpc.req.Term)
+		} else {
+			p.shared.logger.Info("Denied pre-vote from peer",
+				"id", p.shared.peerID,
+				"address", p.shared.peerAddr,
+				"term", rpc.req.Term)
+		}
+	} else if rpc.req.Term == rpc.resp.Term {
 		if rpc.resp.Granted {
 			p.progress.voteGranted = true
 			p.shared.logger.Info("Received vote from peer",
@@ -856,6 +1001,12 @@ type appendEntriesRPC struct {
 	heartbeat     bool
 	pipeline      bool
 	verifyCounter uint64
+
+	// conflictNext is where the leader should resume sending entries,
+	// derived from the ConflictTerm and ConflictIndex hints in a rejection.
+	// It's computed in sendRecv to keep log reads off the peer goroutine. 0
+	// if there's no hint.
+	conflictNext Index
 }
 
 // Returned from prepare() and checked in process() to set
@@ -868,7 +1019,7 @@ func makeHeartbeatRPC(p *peerState) peerRPC {
 	rpc := &appendEntriesRPC{
 		start: start,
 		req: &AppendEntriesRequest{
-			RPCHeader: RPCHeader{p.shared.protocolVersion},
+			RPCHeader: makeRPCHeader(p.control.protocolVersion),
 			Term:      p.control.term,
 			Leader:    p.shared.trans.EncodePeer(p.shared.localAddr),
 
@@ -926,7 +1077,7 @@ func makeAppendEntriesRPC(p *peerState) peerRPC {
 	return &appendEntriesRPC{
 		start: time.Now(),
 		req: &AppendEntriesRequest{
-			RPCHeader:         RPCHeader{p.shared.protocolVersion},
+			RPCHeader:         makeRPCHeader(p.control.protocolVersion),
 			Term:              p.control.term,
 			Leader:            p.shared.trans.EncodePeer(p.shared.localAddr),
 			PrevLogEntry:      p.leader.nextIndex - 1,
@@ -982,7 +1133,7 @@ func (rpc *appendEntriesRPC) prepare(shared *peerShared, control peerControl) er
 	term, err := getTerm(rpc.req.PrevLogEntry)
 	if err != nil {
 		if err != errNeedsSnapshot {
-			shared.logger.Fatal("Failed to get log term",
+			logFatal(shared.logger, "Failed to get log term",
 				"index", rpc.req.PrevLogEntry,
 				"error", err)
 		}
@@ -1000,17 +1151,18 @@ func (rpc *appendEntriesRPC) prepare(shared *peerShared, control peerControl) er
 		numEntries = uint64(lastIndex - rpc.req.PrevLogEntry)
 	}
 	rpc.req.Entries = make([]*Log, 0, numEntries)
-	for i := rpc.req.PrevLogEntry + 1; i <= lastIndex; i++ {
-		var entry Log
-		err := shared.logs.GetLog(i, &entry)
+	if numEntries > 0 {
+		entries, err := getLogs(shared.logs, rpc.req.PrevLogEntry+1, lastIndex, 0)
 		if err == ErrLogNotFound {
 			return errNeedsSnapshot
 		}
 		if err != nil {
-			shared.logger.Fatal("Failed to get log entry",
-				"index", i, "error", err)
+			logFatal(shared.logger, "Failed to get log entries",
+				"first_index", rpc.req.PrevLogEntry+1,
+				"last_index", lastIndex,
+				"error", err)
 		}
-		rpc.req.Entries = append(rpc.req.Entries, &entry)
+		rpc.req.Entries = append(rpc.req.Entries, entries...)
 	}
 	rpc.req.LeaderCommitIndex = control.commitIndex
 	if rpc.req.LeaderCommitIndex > lastIndex {
@@ -1092,11 +1244,43 @@ func (rpc *appendEntriesRPC) sendRecv(shared *peerShared) error {
 			return err
 		}
 	}
-	metrics.MeasureSince([]string{"raft", "replication", "appendEntries", "rpc", string(shared.peerID)}, rpc.start)
-	metrics.IncrCounter([]string{"raft", "replication", "appendEntries", "logs", string(shared.peerID)}, float32(numEntries))
+	shared.options.metrics.MeasureSince([]string{"raft", "replication", "appendEntries", "rpc", string(shared.peerID)}, rpc.start)
+	shared.options.metrics.IncrCounter([]string{"raft", "replication", "appendEntries", "logs", string(shared.peerID)}, float32(numEntries))
+	if !rpc.resp.Success && rpc.resp.ProtocolVersion >= 4 && rpc.resp.ConflictIndex > 0 {
+		rpc.conflictNext = conflictNextIndex(shared.logs, rpc.req, rpc.resp)
+	}
 	return nil
 }
 
+// conflictNextIndex returns where the leader should resume replication after
+// a follower rejected req because its entry at PrevLogEntry has
+// resp.ConflictTerm. If the leader has entries from that term, any the
+// follower shares with it match, so replication resumes just after the
+// leader's last entry of the term. Otherwise none of the follower's entries
+// from that term can match, and replication resumes at resp.ConflictIndex.
+// Either way, a wrong guess only costs another rejection.
+func conflictNextIndex(logs LogStore, req *AppendEntriesRequest, resp *AppendEntriesResponse) Index {
+	next := resp.ConflictIndex
+	if resp.ConflictTerm == 0 || resp.ConflictTerm > req.PrevLogTerm {
+		return next
+	}
+	first, err := logs.FirstIndex()
+	if err != nil || first == 0 || first >= req.PrevLogEntry {
+		return next
+	}
+	// Find the first entry after the term in the leader's log.
+	after, err := searchLogTerms(logs, first, req.PrevLogEntry-1,
+		func(t Term) bool { return t > resp.ConflictTerm })
+	if err != nil || after == first {
+		return next
+	}
+	var entry Log
+	if err := logs.GetLog(after-1, &entry); err != nil || entry.Term != resp.ConflictTerm {
+		return next
+	}
+	return after
+}
+
 func (rpc *appendEntriesRPC) process(p *peerState, err error) {
 	lastIndex := rpc.req.PrevLogEntry + Index(len(rpc.req.Entries))
 
@@ -1134,7 +1318,8 @@ func (rpc *appendEntriesRPC) process(p *peerState, err error) {
 			if p.leader.nextIndex == lastIndex+1 {
 				p.leader.nextIndex = rpc.req.PrevLogEntry + 1
 			}
-			if p.leader.nextCommitIndex == rpc.req.LeaderCommitIndex+1 {
+			if p.leader.nextCommitIndex == rpc.req.LeaderCommitIndex+1 ||
+				p.leader.nextCommitIndex > p.leader.nextIndex {
 				// By this point, we've forgotten what to restore nextCommitIndex to.
 				// Setting it back to 1 will schedule another AppendEntries request.
 				p.leader.nextCommitIndex = 1
@@ -1145,6 +1330,7 @@ func (rpc *appendEntriesRPC) process(p *peerState, err error) {
 
 	// Update progress and leader state based on response.
 	updateTerm(&p.progress, rpc.resp.Term)
+	updateProtocolVersion(&p.progress, rpc.resp.RPCHeader)
 	if p.control.term != rpc.req.Term || p.control.role != Leader {
 		return // term or role changed locally
 	}
@@ -1195,6 +1381,9 @@ func (rpc *appendEntriesRPC) process(p *peerState, err error) {
 		if p.leader.nextIndex > rpc.resp.LastLog+1 {
 			p.leader.nextIndex = rpc.resp.LastLog + 1
 		}
+		if rpc.conflictNext > 0 && p.leader.nextIndex > rpc.conflictNext {
+			p.leader.nextIndex = rpc.conflictNext
+		}
 		if p.leader.nextIndex > p.control.lastIndex+1 {
 			p.leader.nextIndex = p.control.lastIndex + 1
 		}
@@ -1256,7 +1445,7 @@ func (rpc *installSnapshotRPC) prepare(shared *peerShared, control peerControl)
 
 	// Fill in the request.
 	rpc.req = InstallSnapshotRequest{
-		RPCHeader:          RPCHeader{shared.protocolVersion},
+		RPCHeader:          makeRPCHeader(control.protocolVersion),
 		SnapshotVersion:    meta.Version,
 		Term:               control.term,
 		Leader:             shared.trans.EncodePeer(shared.localAddr),
@@ -1282,6 +1471,10 @@ func (rpc *installSnapshotRPC) confirm(p *peerState) error {
 	// Update nextIndex optimistically. Even if this thing fails, we want to kick
 	// back to trying AppendEntries requests.
 	p.leader.nextIndex = rpc.req.LastLogIndex + 1
+	if p.leader.nextCommitIndex > p.leader.nextIndex {
+		// A restored snapshot can move nextIndex backwards.
+		p.leader.nextCommitIndex = p.leader.nextIndex
+	}
 	return nil
 }
 
@@ -1293,7 +1486,7 @@ func (rpc *installSnapshotRPC) sendRecv(shared *peerShared) error {
 	if err != nil {
 		shared.logger.Error("Failed to install snapshot", "id", rpc.snapID, "error", err)
 	}
-	metrics.MeasureSince([]string{"raft", "replication", "installSnapshot", string(shared.peerID)}, rpc.start)
+	shared.options.metrics.MeasureSince([]string{"raft", "replication", "installSnapshot", string(shared.peerID)}, rpc.start)
 	return err
 }
 
@@ -1317,6 +1510,7 @@ func (rpc *installSnapshotRPC) process(p *peerState, err error) {
 
 	// Update progress and leader state based on response.
 	updateTerm(&p.progress, rpc.resp.Term)
+	updateProtocolVersion(&p.progress, rpc.resp.RPCHeader)
 	if p.control.term != rpc.req.Term || p.control.role != Leader {
 		return // term or role changed locally
 	}
@@ -1344,3 +1538,88 @@ func (rpc *installSnapshotRPC) process(p *peerState, err error) {
 			"id", p.shared.peerID, "address", p.shared.peerAddr)
 	}
 }
+
+///////////////////////// TimeoutNow /////////////////////////
+
+type timeoutNowRPC struct {
+	start time.Time
+	req   TimeoutNowRequest
+	resp  TimeoutNowResponse
+}
+
+func makeTimeoutNowRPC(p *peerState) peerRPC {
+	p.leader.outstandingTimeoutNow = true
+	return &timeoutNowRPC{
+		start: time.Now(),
+		req: TimeoutNowRequest{
+			RPCHeader: makeRPCHeader(p.control.protocolVersion),
+			Term:      p.control.term,
+			Leader:    p.shared.trans.EncodePeer(p.shared.localAddr),
+		},
+	}
+}
+
+func (rpc *timeoutNowRPC) started() time.Time {
+	return rpc.start
+}
+
+func (rpc *timeoutNowRPC) prepare(shared *peerShared, control peerControl) error {
+	return nil
+}
+
+func (rpc *timeoutNowRPC) confirm(p *peerState) error {
+	if rpc.req.Term != p.control.term {
+		return errors.New("term changed, discarding TimeoutNow request")
+	}
+	if p.control.role != Leader {
+		return errors.New("no longer leader, discarding TimeoutNow request")
+	}
+	if !p.control.leadershipTransfer {
+		return errors.New("leadership transfer ended, discarding TimeoutNow request")
+	}
+	return nil
+}
+
+func (rpc *timeoutNowRPC) sendRecv(shared *peerShared) error {
+	shared.logger.Info("Sending TimeoutNow to peer",
+		"term", rpc.req.Term,
+		"id", shared.peerID,
+		"address", shared.peerAddr)
+	err := shared.trans.TimeoutNow(shared.peerAddr, &rpc.req, &rpc.resp)
+	if err != nil {
+		shared.logger.Error("Failed to make TimeoutNow RPC to peer",
+			"id", shared.peerID,
+			"address", shared.peerAddr,
+			"error", err)
+	}
+	return err
+}
+
+func (rpc *timeoutNowRPC) process(p *peerState, err error) {
+	// Update bookkeeping on outstanding RPCs.
+	if p.control.term == rpc.req.Term && p.control.role == Leader {
+		p.leader.outstandingTimeoutNow = false
+	}
+
+	// Handle errors during confirm/sendRecv.
+	if err != nil {
+		p.shared.logger.Error("TimeoutNow error to peer",
+			"id", p.shared.peerID,
+			"address", p.shared.peerAddr,
+			"error", err)
+		return
+	}
+
+	// Update progress and leader state based on response.
+	updateTerm(&p.progress, rpc.resp.Term)
+	updateProtocolVersion(&p.progress, rpc.resp.RPCHeader)
+	if p.control.term != rpc.req.Term || p.control.role != Leader {
+		return // term or role changed locally
+	}
+	if p.control.leadershipTransfer {
+		p.leader.timeoutNowSent = true
+	}
+	p.shared.logger.Info("TimeoutNow to peer succeeded",
+		"id", p.shared.peerID,
+		"address", p.shared.peerAddr)
+}
@@ -8,8 +8,6 @@ import (
 	"strings"
 	"testing"
 	"time"
-
-	log "github.com/mgutz/logxi/v1"
 )
 
 type TestingPeer struct {
@@ -18,7 +16,7 @@ type TestingPeer struct {
 	peerTrans    *InmemTransport
 	localAddr    ServerAddress
 	localTrans   *InmemTransport
-	logger       log.Logger
+	logger       Logger
 	logs         LogStore
 	snapshots    SnapshotStore
 	snapshotDir  string
@@ -130,7 +128,6 @@ func makePeerTesting(t *testing.T, tp *TestingPeer) *TestingPeer {
 		tp.goRoutines,
 		tp.localTrans, // give it localTrans so that it can talk to peerTrans
 		tp.localAddr,
-		ProtocolVersionMax,
 		tp.controlCh,
 		tp.progressCh,
 		tp.options)
@@ -158,6 +155,9 @@ func (tp *TestingPeer) close() {
 func maskProgress(progress peerProgress) peerProgress {
 	progress.lastContact = time.Time{}
 	progress.lastReply = time.Time{}
+	// These mirror peerLeaderState, which tests check directly.
+	progress.nextIndex = 0
+	progress.installingSnapshot = false
 	return progress
 }
 
@@ -362,11 +362,12 @@ func oneErrRPC(tp *TestingPeer, expReq interface{}, reply error) error {
 ///////////////////////// RequestVote /////////////////////////
 
 var requestVoteControl = peerControl{
-	term:          84,
-	role:          Candidate,
-	lastIndex:     18,
-	lastTerm:      83,
-	verifyCounter: 120,
+	term:            84,
+	role:            Candidate,
+	lastIndex:       18,
+	lastTerm:        83,
+	verifyCounter:   120,
+	protocolVersion: ProtocolVersionMax,
 }
 
 var requestVoteProgress = peerProgress{
@@ -383,7 +384,7 @@ func TestPeer_RequestVoteRPC_granted(t *testing.T) {
 	})
 	defer tp.close()
 	exp := RequestVoteRequest{
-		RPCHeader:    RPCHeader{ProtocolVersionMax},
+		RPCHeader:    makeRPCHeader(ProtocolVersionMax),
 		Term:         84,
 		Candidate:    tp.localTrans.EncodePeer(tp.localAddr),
 		LastLogIndex: 18,
@@ -514,15 +515,103 @@ func TestPeer_RequestVoteRPC_sendRecvError(t *testing.T) {
 	}
 }
 
+func TestPeer_RequestVoteRPC_preVote_granted(t *testing.T) {
+	control := requestVoteControl
+	control.preVote = true
+	tp := makePeerTesting(t, &TestingPeer{
+		initControl:  &control,
+		initProgress: &requestVoteProgress,
+	})
+	defer tp.close()
+	exp := RequestVoteRequest{
+		RPCHeader:    makeRPCHeader(ProtocolVersionMax),
+		Term:         85,
+		Candidate:    tp.localTrans.EncodePeer(tp.localAddr),
+		LastLogIndex: 18,
+		LastLogTerm:  83,
+		PreVote:      true,
+	}
+	reply := RequestVoteResponse{
+		Term:    84,
+		Granted: true,
+		PreVote: true,
+	}
+	expProgress := peerProgress{
+		peerID:          tp.peerID,
+		term:            84,
+		preVoteGranted:  true,
+		matchIndex:      10,
+		matchTerm:       50,
+		verifiedCounter: 90,
+	}
+	err := oneRPC(tp, &exp, &reply, expProgress)
+	if err != nil {
+		t.Error(err)
+	}
+	if !tp.peer.candidate.voteReplied {
+		t.Errorf("Expected voteReplied to be set")
+	}
+}
+
+func TestPeer_RequestVoteRPC_preVote_unsupported(t *testing.T) {
+	control := requestVoteControl
+	control.preVote = true
+	tp := makePeerTesting(t, &TestingPeer{
+		initControl:  &control,
+		initProgress: &requestVoteProgress,
+	})
+	defer tp.close()
+	// A peer running older code treats the pre-vote as a real vote.
+	reply := RequestVoteResponse{
+		Term:    85,
+		Granted: true,
+	}
+	expProgress := peerProgress{
+		peerID:          tp.peerID,
+		term:            85,
+		matchIndex:      0,
+		matchTerm:       0,
+		verifiedCounter: 90,
+	}
+	err := oneRPC(tp, "RequestVote", &reply, expProgress)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeer_RequestVoteRPC_preVote_confirmError(t *testing.T) {
+	control := requestVoteControl
+	control.preVote = true
+	tp := makePeerTesting(t, &TestingPeer{
+		initControl:  &control,
+		initProgress: &requestVoteProgress,
+	})
+	defer tp.close()
+	rpc := makeRequestVoteRPC(tp.peer)
+	err := rpc.prepare(tp.peer.shared, tp.peer.control)
+	if err != nil {
+		t.Fatalf("Unexpected error in prepare: %v", err)
+	}
+
+	control.preVote = false
+	tp.controlCh <- control
+	tp.peer.blockingSelect()
+	err = rpc.confirm(tp.peer)
+	if err == nil || !strings.Contains(err.Error(), "pre-vote round ended") {
+		t.Fatalf("Expected cancel due to end of pre-vote, got %v", err)
+	}
+}
+
 ///////////////////////// AppendEntries /////////////////////////
 
 var appendEntriesControl = peerControl{
-	term:          83,
-	role:          Leader,
-	lastIndex:     18,
-	lastTerm:      83,
-	commitIndex:   16,
-	verifyCounter: 120,
+	term:            83,
+	role:            Leader,
+	lastIndex:       18,
+	lastTerm:        83,
+	commitIndex:     16,
+	verifyCounter:   120,
+	protocolVersion: ProtocolVersionMax,
 }
 
 var appendEntriesProgress = peerProgress{
@@ -541,7 +630,7 @@ func TestPeer_AppendEntriesRPC_heartbeat(t *testing.T) {
 	tp.peer.failures = 1
 	tp.peer.leader.nextCommitIndex = 2
 	exp := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      1,
@@ -606,7 +695,7 @@ func TestPeer_AppendEntriesRPC_heartbeat_commitIndex(t *testing.T) {
 	defer func() { tp.peer.leader.outstandingInstallSnapshotRPC = false }()
 
 	exp := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      18,
@@ -651,7 +740,7 @@ func testPeer_AppendEntriesRPC_success_noEntries(t *testing.T, pipeline bool) {
 	tp.peer.leader.lastHeartbeatSent = time.Now().Add(time.Minute)
 	tp.peer.leader.nextCommitIndex = 2
 	exp := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      18,
@@ -701,7 +790,7 @@ func testPeer_AppendEntriesRPC_success_oneEntry(t *testing.T, pipeline bool) {
 	tp.peer.leader.nextCommitIndex = 2
 	tp.peer.leader.nextIndex = 18
 	exp := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      17,
@@ -757,7 +846,7 @@ func testPeer_AppendEntriesRPC_success_someEntries(t *testing.T, pipeline bool)
 	tp.peer.leader.nextIndex = 16
 
 	exp1 := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      15,
@@ -773,7 +862,7 @@ func testPeer_AppendEntriesRPC_success_someEntries(t *testing.T, pipeline bool)
 
 	// Immediately send remaining entries.
 	exp2 := AppendEntriesRequest{
-		RPCHeader:         RPCHeader{ProtocolVersionMax},
+		RPCHeader:         makeRPCHeader(ProtocolVersionMax),
 		Term:              83,
 		Leader:            tp.localTrans.EncodePeer(tp.localAddr),
 		PrevLogEntry:      17,
@@ -846,6 +935,55 @@ func testPeer_AppendEntriesRPC_denied(t *testing.T, pipeline bool) {
 	}
 }
 
+func TestPeer_AppendEntriesRPC_conflictHint(t *testing.T) {
+	cases := []struct {
+		name          string
+		conflictTerm  Term
+		conflictIndex Index
+		nextIndex     Index
+	}{
+		// The leader has entries from term 75, up to index 15.
+		{"leaderHasTerm", 75, 12, 16},
+		// The leader has no entries from term 78.
+		{"leaderLacksTerm", 78, 15, 15},
+		// Hints can't move nextIndex forward.
+		{"noRegress", 80, 17, 17},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := makePeerTesting(t, &TestingPeer{
+				initControl:  &appendEntriesControl,
+				initProgress: &appendEntriesProgress,
+			})
+			defer tp.close()
+			tp.peer.leader.nextIndex = 18
+			tp.peer.leader.lastHeartbeatSent = time.Now().Add(time.Minute)
+			reply := AppendEntriesResponse{
+				RPCHeader:     RPCHeader{ProtocolVersion: 4},
+				Term:          83,
+				LastLog:       180,
+				ConflictTerm:  tc.conflictTerm,
+				ConflictIndex: tc.conflictIndex,
+				Success:       false,
+			}
+			expProgress := peerProgress{
+				peerID:             tp.peerID,
+				term:               83,
+				verifiedCounter:    120,
+				protocolVersionMax: 4,
+			}
+			err := oneRPC(tp, "AppendEntries", &reply, expProgress)
+			if err != nil {
+				t.Error(err)
+			}
+			if tp.peer.leader.nextIndex != tc.nextIndex {
+				t.Errorf("nextIndex should be %v, got %v",
+					tc.nextIndex, tp.peer.leader.nextIndex)
+			}
+		})
+	}
+}
+
 func TestPeer_AppendEntriesRPC_noPipeline_newTerm(t *testing.T) {
 	testPeer_AppendEntriesRPC_newTerm(t, false)
 }
@@ -1009,7 +1147,7 @@ func TestPeer_InstallSnapshotRPC_success(t *testing.T) {
 	}
 
 	exp := InstallSnapshotRequest{
-		RPCHeader:          RPCHeader{ProtocolVersionMax},
+		RPCHeader:          makeRPCHeader(ProtocolVersionMax),
 		SnapshotVersion:    getSnapshotVersion(ProtocolVersionMax),
 		Term:               83,
 		Leader:             tp.localTrans.EncodePeer(tp.localAddr),
@@ -45,3 +45,59 @@ func ReadPeersJSON(path string) (Membership, error) {
 	}
 	return membership, nil
 }
+
+// configEntry is used when decoding a new-style peers.json.
+type configEntry struct {
+	// ID is the ID of the server (a UUID, usually).
+	ID ServerID `json:"id"`
+
+	// Address is the host:port of the server.
+	Address ServerAddress `json:"address"`
+
+	// NonVoter controls the suffrage. We choose this sense so people
+	// can leave this out and get a Voter by default.
+	NonVoter bool `json:"non_voter"`
+
+	// Metadata is optional; see Server.Metadata.
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ReadConfigJSON reads a new-style peers.json and returns a membership
+// structure. This can be used to perform manual recovery when running protocol
+// versions that use server IDs. Unlike ReadPeersJSON, it can set each server's
+// suffrage and metadata.
+func ReadConfigJSON(path string) (Membership, error) {
+	// Read in the file.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Membership{}, err
+	}
+
+	// Parse it as JSON.
+	var peers []configEntry
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if err := dec.Decode(&peers); err != nil {
+		return Membership{}, err
+	}
+
+	// Map it into the new-style membership structure.
+	var membership Membership
+	for _, peer := range peers {
+		suffrage := Voter
+		if peer.NonVoter {
+			suffrage = Nonvoter
+		}
+		membership.Servers = append(membership.Servers, Server{
+			Suffrage: suffrage,
+			ID:       peer.ID,
+			Address:  peer.Address,
+			Metadata: peer.Metadata,
+		})
+	}
+
+	// We should only ingest valid configurations.
+	if err := membership.check(); err != nil {
+		return Membership{}, err
+	}
+	return membership, nil
+}
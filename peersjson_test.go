@@ -68,3 +68,64 @@ func Test_PeersJSON(t *testing.T) {
 		t.Fatalf("bad configuration: %+v != %+v", configuration, expected)
 	}
 }
+
+func Test_ConfigJSON(t *testing.T) {
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(base)
+
+	content := []byte(`
+[
+  {
+    "id": "adf4238a-882b-9ddc-4a9d-5b6758e4159e",
+    "address": "127.0.0.1:123",
+    "non_voter": false,
+    "metadata": {"zone": "us-east-1a"}
+  },
+  {
+    "id": "8b6dda82-3103-11e7-93ae-92361f002671",
+    "address": "127.0.0.2:123"
+  },
+  {
+    "id": "97e17742-3103-11e7-93ae-92361f002671",
+    "address": "127.0.0.3:123",
+    "non_voter": true
+  }
+]
+`)
+	peers := filepath.Join(base, "peers.json")
+	if err := ioutil.WriteFile(peers, content, 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	configuration, err := ReadConfigJSON(peers)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := Membership{
+		Servers: []Server{
+			{
+				Suffrage: Voter,
+				ID:       ServerID("adf4238a-882b-9ddc-4a9d-5b6758e4159e"),
+				Address:  ServerAddress("127.0.0.1:123"),
+				Metadata: map[string]string{"zone": "us-east-1a"},
+			},
+			{
+				Suffrage: Voter,
+				ID:       ServerID("8b6dda82-3103-11e7-93ae-92361f002671"),
+				Address:  ServerAddress("127.0.0.2:123"),
+			},
+			{
+				Suffrage: Nonvoter,
+				ID:       ServerID("97e17742-3103-11e7-93ae-92361f002671"),
+				Address:  ServerAddress("127.0.0.3:123"),
+			},
+		},
+	}
+	if !reflect.DeepEqual(configuration, expected) {
+		t.Fatalf("bad configuration: %+v != %+v", configuration, expected)
+	}
+}
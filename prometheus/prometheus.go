@@ -0,0 +1,406 @@
+// Package raftprometheus serves a Raft server's Stats and the go-metrics
+// samples the raft package emits (raft.fsm.apply, raft.snapshot.persist,
+// raft.leader.lastContact, and so on) in the Prometheus text exposition
+// format. Give each Raft server its own Sink by setting Config.Metrics to
+// raft.SinkMetrics{Sink: sink}, or install a Sink with go-metrics (for example
+// with metrics.NewGlobal), then serve a Handler built from the same Sink.
+package raftprometheus
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+)
+
+// ContentType is the Content-Type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricType int
+
+const (
+	gaugeType metricType = iota
+	counterType
+	summaryType
+)
+
+func (t metricType) String() string {
+	switch t {
+	case gaugeType:
+		return "gauge"
+	case counterType:
+		return "counter"
+	case summaryType:
+		return "summary"
+	}
+	return "untyped"
+}
+
+// series is one labelled time series within a family.
+type series struct {
+	labels []metrics.Label
+	value  float64 // gauge value or counter total
+	count  uint64  // number of samples, summaries only
+	sum    float64 // sum of samples, summaries only
+}
+
+// family holds all the series that share a metric name.
+type family struct {
+	typ    metricType
+	series map[string]*series
+}
+
+// Sink is a go-metrics MetricSink that keeps the latest value of every gauge,
+// the running total of every counter, and the count and sum of every sample,
+// so that they can be scraped. It's safe for concurrent use.
+type Sink struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+// NewSink returns an empty Sink.
+func NewSink() *Sink {
+	return &Sink{
+		families: make(map[string]*family),
+	}
+}
+
+// SetGauge is part of metrics.MetricSink.
+func (s *Sink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+// SetGaugeWithLabels is part of metrics.MetricSink.
+func (s *Sink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.update(key, gaugeType, labels, func(ts *series) {
+		ts.value = float64(val)
+	})
+}
+
+// EmitKey is part of metrics.MetricSink. Emitted keys are exposed as gauges.
+func (s *Sink) EmitKey(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+// IncrCounter is part of metrics.MetricSink.
+func (s *Sink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+// IncrCounterWithLabels is part of metrics.MetricSink.
+func (s *Sink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.update(key, counterType, labels, func(ts *series) {
+		ts.value += float64(val)
+	})
+}
+
+// AddSample is part of metrics.MetricSink.
+func (s *Sink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+// AddSampleWithLabels is part of metrics.MetricSink. go-metrics reports
+// timings in milliseconds; they're exposed unchanged as a summary's sum and
+// count.
+func (s *Sink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.update(key, summaryType, labels, func(ts *series) {
+		ts.count++
+		ts.sum += float64(val)
+	})
+}
+
+// update finds or creates the series for key and labels and applies fn to it.
+// Updates whose type conflicts with earlier updates to the same name are
+// dropped, since a Prometheus family can only have one type.
+func (s *Sink) update(key []string, typ metricType, labels []metrics.Label, fn func(*series)) {
+	name := metricName(key)
+	labels = sanitizeLabels(labels)
+	id := labelsID(labels)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{typ: typ, series: make(map[string]*series)}
+		s.families[name] = f
+	} else if f.typ != typ {
+		return
+	}
+	ts, ok := f.series[id]
+	if !ok {
+		ts = &series{labels: labels}
+		f.series[id] = ts
+	}
+	fn(ts)
+}
+
+// Handler serves a Raft server's Stats and the contents of a Sink.
+type Handler struct {
+	raft *raft.Raft
+	sink *Sink
+	// timeout bounds how long a scrape waits for the Raft server to answer
+	// a Stats request.
+	timeout time.Duration
+}
+
+// NewHandler returns an http.Handler that serves r's Stats and the metrics
+// collected by sink in the Prometheus text format. Every series is labelled
+// with the server's ID and current state. Either r or sink may be nil. If r
+// is shut down or doesn't answer within timeout, only sink's metrics are
+// served.
+func NewHandler(r *raft.Raft, sink *Sink, timeout time.Duration) *Handler {
+	return &Handler{
+		raft:    r,
+		sink:    sink,
+		timeout: timeout,
+	}
+}
+
+// ServeHTTP is part of http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var stats *raft.Stats
+	if h.raft != nil {
+		stats = h.stats()
+	}
+	var common []metrics.Label
+	if stats != nil {
+		common = []metrics.Label{
+			{Name: "server_id", Value: string(stats.ServerID)},
+			{Name: "state", Value: stats.State.String()},
+		}
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	bw := bufio.NewWriter(w)
+	if stats != nil {
+		writeStats(bw, stats, common)
+	}
+	if h.sink != nil {
+		h.sink.write(bw, common)
+	}
+	bw.Flush()
+}
+
+// stats fetches Stats from the Raft server, returning nil on error or timeout.
+func (h *Handler) stats() *raft.Stats {
+	future := h.raft.Stats()
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+	var timer <-chan time.Time
+	if h.timeout > 0 {
+		timer = time.After(h.timeout)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil
+		}
+		return future.Stats()
+	case <-timer:
+		return nil
+	}
+}
+
+// writeStats writes the numeric fields of stats as gauges.
+func writeStats(w *bufio.Writer, stats *raft.Stats, common []metrics.Label) {
+	gauge := func(name string, value float64) {
+		writeType(w, name, gaugeType)
+		writeSample(w, name, common, nil, value)
+	}
+	gauge("raft_term", float64(stats.Term))
+	gauge("raft_last_log_index", float64(stats.LastLogIndex))
+	gauge("raft_last_log_term", float64(stats.LastLogTerm))
+	gauge("raft_commit_index", float64(stats.CommitIndex))
+	gauge("raft_applied_index", float64(stats.AppliedIndex))
+	gauge("raft_fsm_pending", float64(stats.FSMPending))
+	gauge("raft_last_snapshot_index", float64(stats.LastSnapshotIndex))
+	gauge("raft_last_snapshot_term", float64(stats.LastSnapshotTerm))
+	gauge("raft_latest_membership_index", float64(stats.LatestMembershipIndex))
+	gauge("raft_num_peers", float64(stats.NumPeers))
+	gauge("raft_protocol_version", float64(stats.ProtocolVersion))
+	if !stats.LastContact.IsZero() && stats.State != raft.Leader {
+		gauge("raft_last_contact_seconds",
+			time.Since(stats.LastContact).Seconds())
+	}
+
+	if len(stats.Peers) == 0 {
+		return
+	}
+	peerGauge := func(name string, value func(raft.PeerStats) (float64, bool)) {
+		writeType(w, name, gaugeType)
+		for _, peer := range stats.Peers {
+			v, ok := value(peer)
+			if !ok {
+				continue
+			}
+			writeSample(w, name, common, []metrics.Label{
+				{Name: "peer_id", Value: string(peer.ID)},
+			}, v)
+		}
+	}
+	peerGauge("raft_peer_match_index", func(p raft.PeerStats) (float64, bool) {
+		return float64(p.MatchIndex), true
+	})
+	peerGauge("raft_peer_next_index", func(p raft.PeerStats) (float64, bool) {
+		return float64(p.NextIndex), true
+	})
+	peerGauge("raft_peer_lag", func(p raft.PeerStats) (float64, bool) {
+		return float64(p.Lag), true
+	})
+	peerGauge("raft_peer_last_contact_seconds", func(p raft.PeerStats) (float64, bool) {
+		if p.LastContact.IsZero() {
+			return 0, false
+		}
+		return time.Since(p.LastContact).Seconds(), true
+	})
+	peerGauge("raft_peer_installing_snapshot", func(p raft.PeerStats) (float64, bool) {
+		if p.InstallingSnapshot {
+			return 1, true
+		}
+		return 0, true
+	})
+}
+
+// write writes every family in the sink, sorted by name and then labels.
+func (s *Sink) write(w *bufio.Writer, common []metrics.Label) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := s.families[name]
+		ids := make([]string, 0, len(f.series))
+		for id := range f.series {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		writeType(w, name, f.typ)
+		for _, id := range ids {
+			ts := f.series[id]
+			switch f.typ {
+			case summaryType:
+				writeSample(w, name+"_sum", common, ts.labels, ts.sum)
+				writeSample(w, name+"_count", common, ts.labels, float64(ts.count))
+			default:
+				writeSample(w, name, common, ts.labels, ts.value)
+			}
+		}
+	}
+}
+
+func writeType(w *bufio.Writer, name string, typ metricType) {
+	fmt.Fprintf(w, "# TYPE %s %v\n", name, typ)
+}
+
+// writeSample writes a single line. Labels in extra override common labels of
+// the same name.
+func writeSample(w *bufio.Writer, name string, common, extra []metrics.Label, value float64) {
+	w.WriteString(name)
+	first := true
+	writeLabel := func(l metrics.Label) {
+		if first {
+			w.WriteByte('{')
+			first = false
+		} else {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+	}
+	for _, l := range common {
+		overridden := false
+		for _, e := range extra {
+			if e.Name == l.Name {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			writeLabel(l)
+		}
+	}
+	for _, l := range extra {
+		writeLabel(l)
+	}
+	if !first {
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// metricName joins a go-metrics key into a valid Prometheus metric name, so
+// that raft.fsm.apply becomes raft_fsm_apply.
+func metricName(key []string) string {
+	name := sanitize(strings.Join(key, "_"), true)
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// sanitizeLabels returns labels with valid names, sorted by name.
+func sanitizeLabels(labels []metrics.Label) []metrics.Label {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make([]metrics.Label, len(labels))
+	for i, l := range labels {
+		out[i] = metrics.Label{Name: sanitize(l.Name, false), Value: l.Value}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// labelsID returns a string that uniquely identifies a sorted set of labels.
+func labelsID(labels []metrics.Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		fmt.Fprintf(&b, "%q=%q,", l.Name, l.Value)
+	}
+	return b.String()
+}
+
+// sanitize replaces characters that aren't allowed in Prometheus metric names
+// (or, if colons is false, label names) with underscores.
+func sanitize(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && colons:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,123 @@
+package raftprometheus
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+)
+
+type nullFSM struct{}
+
+type nullSnapshot struct{}
+
+func (nullFSM) Apply(*raft.Log) interface{}               { return nil }
+func (nullFSM) Snapshot() (raft.FSMSnapshot, error)       { return nullSnapshot{}, nil }
+func (nullFSM) Restore(rc io.ReadCloser) error            { return rc.Close() }
+func (nullSnapshot) Persist(sink raft.SnapshotSink) error { return sink.Close() }
+func (nullSnapshot) Release()                             {}
+
+func scrape(t *testing.T, h *Handler) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("bad content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestSink(t *testing.T) {
+	sink := NewSink()
+	sink.SetGauge([]string{"raft", "state", "leader"}, 1)
+	sink.SetGauge([]string{"raft", "state", "leader"}, 2)
+	sink.IncrCounter([]string{"raft", "apply"}, 1)
+	sink.IncrCounter([]string{"raft", "apply"}, 2)
+	sink.AddSample([]string{"raft", "fsm", "apply"}, 1.5)
+	sink.AddSample([]string{"raft", "fsm", "apply"}, 2.5)
+	sink.AddSampleWithLabels([]string{"raft", "rpc", "appendEntries"}, 3,
+		[]metrics.Label{{Name: "peer.id", Value: `a"b`}})
+	// Conflicting types for a name are dropped.
+	sink.IncrCounter([]string{"raft", "fsm", "apply"}, 100)
+
+	body := scrape(t, NewHandler(nil, sink, 0))
+	expectLines(t, body,
+		"# TYPE raft_state_leader gauge",
+		"raft_state_leader 2",
+		"# TYPE raft_apply counter",
+		"raft_apply 3",
+		"# TYPE raft_fsm_apply summary",
+		"raft_fsm_apply_sum 4",
+		"raft_fsm_apply_count 2",
+		`raft_rpc_appendEntries_sum{peer_id="a\"b"} 3`,
+		`raft_rpc_appendEntries_count{peer_id="a\"b"} 1`,
+	)
+	if strings.Count(body, "# TYPE raft_fsm_apply ") != 1 {
+		t.Errorf("expected a single raft_fsm_apply family in:\n%s", body)
+	}
+}
+
+func TestHandler_Stats(t *testing.T) {
+	conf := raft.DefaultConfig()
+	conf.LocalID = "id1"
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.Logger = raft.NewRaftLoggerForTesting(os.Stderr, "")
+	store := raft.NewInmemStore()
+	addr, trans := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(conf, nullFSM{}, store, store,
+		raft.NewDiscardSnapshotStore(), trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+	err = r.BootstrapCluster(raft.Membership{
+		Servers: []raft.Server{{Suffrage: raft.Voter, ID: conf.LocalID, Address: addr}},
+	}).Error()
+	if err != nil {
+		t.Fatalf("bootstrap err: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Leader() != addr {
+		if time.Now().After(deadline) {
+			t.Fatalf("no leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sink := NewSink()
+	sink.AddSampleWithLabels([]string{"raft", "fsm", "apply"}, 1,
+		[]metrics.Label{{Name: "state", Value: "override"}})
+	body := scrape(t, NewHandler(r, sink, time.Second))
+	expectLines(t, body,
+		"# TYPE raft_term gauge",
+		`raft_num_peers{server_id="id1",state="Leader"} 0`,
+		`raft_fsm_apply_count{server_id="id1",state="override"} 1`,
+	)
+	if !strings.Contains(body, `raft_term{server_id="id1",state="Leader"} `) {
+		t.Errorf("missing raft_term in:\n%s", body)
+	}
+
+	// Once shut down, only the sink's metrics remain.
+	if err := r.Shutdown().Error(); err != nil {
+		t.Fatalf("shutdown err: %v", err)
+	}
+	body = scrape(t, NewHandler(r, sink, time.Second))
+	if strings.Contains(body, "raft_term") {
+		t.Errorf("unexpected stats after shutdown:\n%s", body)
+	}
+	expectLines(t, body, "raft_fsm_apply_count{state=\"override\"} 1")
+}
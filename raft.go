@@ -1,13 +1,13 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/armon/go-metrics"
 )
 
 var (
@@ -41,6 +41,18 @@ var (
 	// ErrCantBootstrap is returned when attempt is made to bootstrap a
 	// cluster that already has state present.
 	ErrCantBootstrap = errors.New("bootstrap only works on new clusters")
+
+	// ErrLeadershipTransferInProgress is returned when the leader is rejecting
+	// client requests because it is attempting to transfer leadership.
+	ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
+
+	// ErrNoLeader is returned when an operation needs to contact the leader
+	// but no leader is currently known.
+	ErrNoLeader = errors.New("no known leader")
+
+	// ErrAbortedByRestore is returned when a leader fails to commit a log
+	// entry because it's been superseded by a user snapshot restore.
+	ErrAbortedByRestore = errors.New("snapshot restored while committing log")
 )
 
 type Raft struct {
@@ -51,10 +63,23 @@ type Raft struct {
 	// goRoutines tracks running goroutines.
 	goRoutines *waitGroup
 
+	// shared holds state that the Raft server publishes for safe access from
+	// outside of the main thread.
+	shared *raftShared
+
 	// protocolVersion is used to transition between different versions of the
 	// library. See comments in config.go for more details.
 	protocolVersion ProtocolVersion
 
+	// leaseReads is set from Config.LeaseReads.
+	leaseReads bool
+
+	// trans is used to ask the leader for a read index.
+	trans Transport
+
+	// metrics is shared with the raftServer.
+	metrics Metrics
+
 	// serverInternals is used from unit tests to get at internals.
 	serverInternals *raftServer
 }
@@ -64,6 +89,10 @@ type apiChannels struct {
 	// be committed and applied to the FSM.
 	applyCh chan *logFuture
 
+	// applyBatchCh is like applyCh, but for log futures that must be
+	// dispatched together.
+	applyBatchCh chan []*logFuture
+
 	// Used to request the leader to make membership configuration changes.
 	membershipChangeCh chan *membershipChangeFuture
 
@@ -85,6 +114,18 @@ type apiChannels struct {
 	// the main thread.
 	bootstrapCh chan *bootstrapFuture
 
+	// leadershipTransferCh is used to ask the leader to hand off leadership
+	// to another server.
+	leadershipTransferCh chan *leadershipTransferFuture
+
+	// gracefulShutdownCh is used to ask the leader to drain its inflight
+	// entries and then hand off leadership, ahead of shutting down.
+	gracefulShutdownCh chan *leadershipTransferFuture
+
+	// restoreCh is used to ask the leader to restore a user-provided
+	// snapshot.
+	restoreCh chan *userRestoreFuture
+
 	// leaderCh is used to notify the application of leadership changes. See
 	// Raft.LeaderCh().
 	leaderCh chan bool
@@ -100,24 +141,32 @@ type apiChannels struct {
 func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps SnapshotStore, trans Transport) (*Raft, error) {
 	api := &Raft{
 		channels: &apiChannels{
-			applyCh:            make(chan *logFuture),
-			membershipChangeCh: make(chan *membershipChangeFuture),
-			snapshotCh:         make(chan *snapshotFuture),
-			verifyCh:           make(chan *verifyFuture, 64),
-			membershipsCh:      make(chan *membershipsFuture, 8),
-			statsCh:            make(chan *statsFuture, 8),
-			bootstrapCh:        make(chan *bootstrapFuture),
-			leaderCh:           make(chan bool),
-			shutdownCh:         make(chan struct{}),
+			applyCh:              make(chan *logFuture),
+			applyBatchCh:         make(chan []*logFuture),
+			membershipChangeCh:   make(chan *membershipChangeFuture),
+			snapshotCh:           make(chan *snapshotFuture),
+			verifyCh:             make(chan *verifyFuture, 64),
+			membershipsCh:        make(chan *membershipsFuture, 8),
+			statsCh:              make(chan *statsFuture, 8),
+			bootstrapCh:          make(chan *bootstrapFuture),
+			leadershipTransferCh: make(chan *leadershipTransferFuture),
+			gracefulShutdownCh:   make(chan *leadershipTransferFuture),
+			restoreCh:            make(chan *userRestoreFuture),
+			leaderCh:             make(chan bool),
+			shutdownCh:           make(chan struct{}),
 		},
 		goRoutines:      &waitGroup{},
+		shared:          &raftShared{},
 		protocolVersion: conf.ProtocolVersion,
+		leaseReads:      conf.LeaseReads,
+		trans:           trans,
 	}
-	server, err := newRaftServer(conf, fsm, logs, stable, snaps, trans, api.channels, api.goRoutines)
+	server, err := newRaftServer(conf, fsm, logs, stable, snaps, trans, api.shared, api.channels, api.goRoutines)
 	if err != nil {
 		return nil, err
 	}
 	api.serverInternals = server
+	api.metrics = server.metrics
 	return api, nil
 }
 
@@ -145,7 +194,7 @@ func (r *Raft) BootstrapCluster(membership Membership) Future {
 // for the command to be started. This must be run on the leader or it
 // will fail.
 func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
-	metrics.IncrCounter([]string{"raft", "apply"}, 1)
+	r.metrics.IncrCounter([]string{"raft", "apply"}, 1)
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
@@ -170,13 +219,84 @@ func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
 	}
 }
 
+// ApplyBatch is used to apply several commands to the FSM as one unit. The
+// commands are written to the log together, with contiguous indexes and no
+// other entries interleaved, and are applied to the FSM in order. This returns
+// a future that can be used to wait on the application of the whole batch.
+// An optional timeout can be provided to limit the amount of time we wait for
+// the commands to be started. This must be run on the leader or it will fail.
+//
+// If the leader fails partway, a prefix of the batch may still be committed;
+// the future then returns the error of the first entry that failed.
+func (r *Raft) ApplyBatch(cmds [][]byte, timeout time.Duration) ApplyBatchFuture {
+	r.metrics.IncrCounter([]string{"raft", "apply"}, float32(len(cmds)))
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	// Create a log future for each command, no index or term yet
+	batch := &batchFuture{
+		futures: make([]*logFuture, len(cmds)),
+	}
+	for i, cmd := range cmds {
+		batch.futures[i] = &logFuture{
+			log: Log{
+				Type: LogCommand,
+				Data: cmd,
+			},
+		}
+		batch.futures[i].init()
+	}
+	if len(cmds) == 0 {
+		return batch
+	}
+
+	select {
+	case <-timer:
+		return &batchFuture{err: ErrEnqueueTimeout}
+	case <-r.channels.shutdownCh:
+		return &batchFuture{err: ErrRaftShutdown}
+	case r.channels.applyBatchCh <- batch.futures:
+		return batch
+	}
+}
+
+// ApplyContext is like Apply, but gives up waiting for the command to be
+// started once ctx is done. If ctx is done before the leader has written the
+// command to its log, the command is dropped and the future returns
+// ctx.Err(). Use ErrorContext with the returned future to also bound the wait
+// for the command to be applied.
+func (r *Raft) ApplyContext(ctx context.Context, cmd []byte) ApplyFuture {
+	r.metrics.IncrCounter([]string{"raft", "apply"}, 1)
+
+	// Create a log future, no index or term yet
+	logFuture := &logFuture{
+		log: Log{
+			Type: LogCommand,
+			Data: cmd,
+		},
+		ctx: ctx,
+	}
+	logFuture.init()
+
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.channels.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.channels.applyCh <- logFuture:
+		return logFuture
+	}
+}
+
 // Barrier is used to issue a command that blocks until all preceeding
 // operations have been applied to the FSM. It can be used to ensure the
 // FSM reflects all queued writes. An optional timeout can be provided to
 // limit the amount of time we wait for the command to be started. This
 // must be run on the leader or it will fail.
 func (r *Raft) Barrier(timeout time.Duration) Future {
-	metrics.IncrCounter([]string{"raft", "barrier"}, 1)
+	r.metrics.IncrCounter([]string{"raft", "barrier"}, 1)
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
@@ -200,11 +320,37 @@ func (r *Raft) Barrier(timeout time.Duration) Future {
 	}
 }
 
+// BarrierContext is like Barrier, but gives up waiting for the command to be
+// started once ctx is done. If ctx is done before the leader has written the
+// barrier to its log, the barrier is dropped and the future returns
+// ctx.Err().
+func (r *Raft) BarrierContext(ctx context.Context) Future {
+	r.metrics.IncrCounter([]string{"raft", "barrier"}, 1)
+
+	// Create a log future, no index or term yet
+	logFuture := &logFuture{
+		log: Log{
+			Type: LogBarrier,
+		},
+		ctx: ctx,
+	}
+	logFuture.init()
+
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.channels.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.channels.applyCh <- logFuture:
+		return logFuture
+	}
+}
+
 // VerifyLeader is used to ensure the current node is still
 // the leader. This can be done to prevent stale reads when a
 // new leader has potentially been elected.
 func (r *Raft) VerifyLeader() Future {
-	metrics.IncrCounter([]string{"raft", "verify_leader"}, 1)
+	r.metrics.IncrCounter([]string{"raft", "verify_leader"}, 1)
 	verifyFuture := &verifyFuture{}
 	verifyFuture.shutdownCh = r.channels.shutdownCh
 	verifyFuture.init()
@@ -216,6 +362,114 @@ func (r *Raft) VerifyLeader() Future {
 	}
 }
 
+// VerifyLeaderContext is like VerifyLeader, but gives up waiting for the
+// request to be started once ctx is done. If ctx is done before the leader
+// starts its round of heartbeats, the request is dropped and the future returns
+// ctx.Err().
+func (r *Raft) VerifyLeaderContext(ctx context.Context) Future {
+	r.metrics.IncrCounter([]string{"raft", "verify_leader"}, 1)
+	verifyFuture := &verifyFuture{ctx: ctx}
+	verifyFuture.shutdownCh = r.channels.shutdownCh
+	verifyFuture.init()
+	select {
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
+	case <-r.channels.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.channels.verifyCh <- verifyFuture:
+		return verifyFuture
+	}
+}
+
+// ReadIndex is used to serve linearizable reads without writing to the log.
+// It records the leader's commit index, confirms leadership with a round of
+// heartbeats to a quorum, then waits until the local FSM has applied that
+// index. Once it returns successfully, reading from the FSM reflects every
+// write that completed before ReadIndex was called. It returns the read index.
+// This must be run on the leader or it will fail with ErrNotLeader.
+//
+// With Config.LeaseReads, the heartbeat round is skipped while the leader
+// holds its read lease.
+func (r *Raft) ReadIndex(ctx context.Context) (Index, error) {
+	r.metrics.IncrCounter([]string{"raft", "read_index"}, 1)
+	if r.leaseReads {
+		if index, ok := r.shared.getLease(); ok {
+			r.metrics.IncrCounter([]string{"raft", "read_index", "lease"}, 1)
+			if err := r.shared.waitApplied(ctx, index, r.channels.shutdownCh); err != nil {
+				return 0, err
+			}
+			return index, nil
+		}
+		r.metrics.IncrCounter([]string{"raft", "read_index", "fallback"}, 1)
+	}
+	verifyFuture := &verifyFuture{}
+	verifyFuture.shutdownCh = r.channels.shutdownCh
+	verifyFuture.init()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-r.channels.shutdownCh:
+		return 0, ErrRaftShutdown
+	case r.channels.verifyCh <- verifyFuture:
+	}
+	if err := verifyFuture.ErrorContext(ctx); err != nil {
+		return 0, err
+	}
+	index := verifyFuture.index
+	if err := r.shared.waitApplied(ctx, index, r.channels.shutdownCh); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// FollowerReadIndex is like ReadIndex, but may also be run on followers and
+// nonvoters. A follower asks the leader for its read index over the transport,
+// then waits until its own FSM has applied that index. Once it returns
+// successfully, reading from the local FSM reflects every write that completed
+// before FollowerReadIndex was called. It fails with ErrNoLeader if no leader
+// is known. On the leader, this is the same as ReadIndex. Transports don't take
+// a context, so if ctx is done first, the request to the leader still runs
+// until the transport times it out, and Shutdown waits for it.
+func (r *Raft) FollowerReadIndex(ctx context.Context) (Index, error) {
+	leader, _ := r.shared.getLeader()
+	if leader == "" {
+		return 0, ErrNoLeader
+	}
+	if leader == r.trans.LocalAddr() {
+		return r.ReadIndex(ctx)
+	}
+
+	r.metrics.IncrCounter([]string{"raft", "follower_read_index"}, 1)
+	req := &ReadIndexRequest{
+		RPCHeader: makeRPCHeader(r.shared.getProtocolVersion()),
+	}
+	var resp ReadIndexResponse
+	errCh := make(chan error, 1)
+	select {
+	case <-r.channels.shutdownCh:
+		return 0, ErrRaftShutdown
+	default:
+	}
+	r.goRoutines.spawn(func() {
+		errCh <- r.trans.ReadIndex(leader, req, &resp)
+	})
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-r.channels.shutdownCh:
+		return 0, ErrRaftShutdown
+	}
+
+	if err := r.shared.waitApplied(ctx, resp.Index, r.channels.shutdownCh); err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
 // GetMembership returns the latest membership configuration and its associated index
 // currently in use. This may not yet be committed. This must not be called on
 // the main thread (which can access the information directly).
@@ -234,8 +488,8 @@ func (r *Raft) GetMembership() MembershipFuture {
 
 // requestMembershipChange is a helper for the functions that make
 // membership change requests. 'req' describes the change. For timeout,
-// see AddVoter.
-func (r *Raft) requestMembershipChange(req membershipChangeRequest, timeout time.Duration) IndexFuture {
+// see AddVoter. For ctx, see AddVoterContext.
+func (r *Raft) requestMembershipChange(ctx context.Context, req membershipChangeRequest, timeout time.Duration) IndexFuture {
 	var timer <-chan time.Time
 	if timeout > 0 {
 		timer = time.After(timeout)
@@ -243,10 +497,13 @@ func (r *Raft) requestMembershipChange(req membershipChangeRequest, timeout time
 	future := &membershipChangeFuture{
 		req: req,
 	}
+	future.ctx = ctx
 	future.init()
 	select {
 	case <-timer:
 		return errorFuture{ErrEnqueueTimeout}
+	case <-ctx.Done():
+		return errorFuture{ctx.Err()}
 	case r.channels.membershipChangeCh <- future:
 		return future
 	case <-r.channels.shutdownCh:
@@ -261,7 +518,7 @@ func (r *Raft) AddPeer(peer ServerAddress) Future {
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:       AddStaging,
 		serverID:      ServerID(peer),
 		serverAddress: peer,
@@ -278,7 +535,7 @@ func (r *Raft) RemovePeer(peer ServerAddress) Future {
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:   RemoveServer,
 		serverID:  ServerID(peer),
 		prevIndex: 0,
@@ -298,7 +555,7 @@ func (r *Raft) AddVoter(id ServerID, address ServerAddress, prevIndex Index, tim
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:       AddStaging,
 		serverID:      id,
 		serverAddress: address,
@@ -316,7 +573,7 @@ func (r *Raft) AddNonvoter(id ServerID, address ServerAddress, prevIndex Index,
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:       AddNonvoter,
 		serverID:      id,
 		serverAddress: address,
@@ -324,6 +581,40 @@ func (r *Raft) AddNonvoter(id ServerID, address ServerAddress, prevIndex Index,
 	}, timeout)
 }
 
+// AddVoterWithMetadata is like AddVoter, but also sets the server's metadata,
+// replacing any it had. A nil metadata leaves it unchanged. It needs protocol
+// version 6.
+func (r *Raft) AddVoterWithMetadata(id ServerID, address ServerAddress, metadata map[string]string, prevIndex Index, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
+		command:        AddStaging,
+		serverID:       id,
+		serverAddress:  address,
+		serverMetadata: cloneMetadata(metadata),
+		prevIndex:      prevIndex,
+	}, timeout)
+}
+
+// AddNonvoterWithMetadata is like AddNonvoter, but also sets the server's
+// metadata, replacing any it had. A nil metadata leaves it unchanged. It needs
+// protocol version 6.
+func (r *Raft) AddNonvoterWithMetadata(id ServerID, address ServerAddress, metadata map[string]string, prevIndex Index, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
+		command:        AddNonvoter,
+		serverID:       id,
+		serverAddress:  address,
+		serverMetadata: cloneMetadata(metadata),
+		prevIndex:      prevIndex,
+	}, timeout)
+}
+
 // RemoveServer will remove the given server from the cluster. If the current
 // leader is being removed, it will cause a new election to occur. This must be
 // run on the leader or it will fail. For prevIndex and timeout, see AddVoter.
@@ -332,7 +623,7 @@ func (r *Raft) RemoveServer(id ServerID, prevIndex Index, timeout time.Duration)
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:   RemoveServer,
 		serverID:  id,
 		prevIndex: prevIndex,
@@ -349,13 +640,181 @@ func (r *Raft) DemoteVoter(id ServerID, prevIndex Index, timeout time.Duration)
 		return errorFuture{ErrUnsupportedProtocol}
 	}
 
-	return r.requestMembershipChange(membershipChangeRequest{
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
 		command:   DemoteVoter,
 		serverID:  id,
 		prevIndex: prevIndex,
 	}, timeout)
 }
 
+// UpdateServerAddress changes the address of a server already in the
+// cluster, keeping its suffrage. Unlike removing and re-adding it, the server
+// keeps counting towards quorum throughout, so this suits a host that has moved
+// to a new address. The leader starts sending to the new address as soon as
+// the change is appended. This must be run on the leader or it will fail, and
+// can't change the leader's own address. For prevIndex and timeout, see
+// AddVoter.
+func (r *Raft) UpdateServerAddress(id ServerID, address ServerAddress, prevIndex Index, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(context.Background(), membershipChangeRequest{
+		command:       UpdateAddress,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, timeout)
+}
+
+// ChangeMembership replaces all the servers in the cluster with those in
+// target at once, using joint consensus. The leader first appends a joint
+// configuration, in which elections and commitment need majorities of both
+// the current and the target voters, then, once that has committed, the
+// target configuration on its own. The returned future waits for the target
+// configuration to commit and gives its index. This must be run on the
+// leader or it will fail. It needs protocol version 5, so every server in
+// target must run a version of this library that supports it. For prevIndex
+// and timeout, see AddVoter.
+func (r *Raft) ChangeMembership(target Membership, prevIndex Index, timeout time.Duration) IndexFuture {
+	return r.changeMembership(context.Background(), target, prevIndex, timeout)
+}
+
+// changeMembership implements ChangeMembership and ChangeMembershipContext.
+func (r *Raft) changeMembership(ctx context.Context, target Membership, prevIndex Index, timeout time.Duration) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+	if target.joint() {
+		return errorFuture{fmt.Errorf("target membership may not have old servers")}
+	}
+	if err := target.check(); err != nil {
+		return errorFuture{err}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:   EnterJoint,
+		servers:   target.Clone().Servers,
+		prevIndex: prevIndex,
+	}, timeout)
+}
+
+// AddVoterContext is like AddVoter, but gives up waiting for the change to be
+// started once ctx is done. If ctx is done before the leader has appended the
+// configuration change log entry, the change is dropped and the future returns
+// ctx.Err().
+func (r *Raft) AddVoterContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 2 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:       AddStaging,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, 0)
+}
+
+// AddNonvoterContext is like AddNonvoter, but takes a context. See
+// AddVoterContext.
+func (r *Raft) AddNonvoterContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:       AddNonvoter,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, 0)
+}
+
+// RemoveServerContext is like RemoveServer, but takes a context. See
+// AddVoterContext.
+func (r *Raft) RemoveServerContext(ctx context.Context, id ServerID, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 2 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:   RemoveServer,
+		serverID:  id,
+		prevIndex: prevIndex,
+	}, 0)
+}
+
+// DemoteVoterContext is like DemoteVoter, but takes a context. See
+// AddVoterContext.
+func (r *Raft) DemoteVoterContext(ctx context.Context, id ServerID, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:   DemoteVoter,
+		serverID:  id,
+		prevIndex: prevIndex,
+	}, 0)
+}
+
+// AddVoterWithMetadataContext is like AddVoterWithMetadata, but takes a
+// context. See AddVoterContext.
+func (r *Raft) AddVoterWithMetadataContext(ctx context.Context, id ServerID, address ServerAddress, metadata map[string]string, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:        AddStaging,
+		serverID:       id,
+		serverAddress:  address,
+		serverMetadata: cloneMetadata(metadata),
+		prevIndex:      prevIndex,
+	}, 0)
+}
+
+// AddNonvoterWithMetadataContext is like AddNonvoterWithMetadata, but takes a
+// context. See AddVoterContext.
+func (r *Raft) AddNonvoterWithMetadataContext(ctx context.Context, id ServerID, address ServerAddress, metadata map[string]string, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:        AddNonvoter,
+		serverID:       id,
+		serverAddress:  address,
+		serverMetadata: cloneMetadata(metadata),
+		prevIndex:      prevIndex,
+	}, 0)
+}
+
+// UpdateServerAddressContext is like UpdateServerAddress, but takes a context.
+// See AddVoterContext.
+func (r *Raft) UpdateServerAddressContext(ctx context.Context, id ServerID, address ServerAddress, prevIndex Index) IndexFuture {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.requestMembershipChange(ctx, membershipChangeRequest{
+		command:       UpdateAddress,
+		serverID:      id,
+		serverAddress: address,
+		prevIndex:     prevIndex,
+	}, 0)
+}
+
+// ChangeMembershipContext is like ChangeMembership, but takes a context. If
+// ctx is done before the leader has appended the joint configuration, the
+// change is dropped and the future returns ctx.Err(). Once the joint
+// configuration is appended, the leader finishes the change regardless. See
+// AddVoterContext.
+func (r *Raft) ChangeMembershipContext(ctx context.Context, target Membership, prevIndex Index) IndexFuture {
+	return r.changeMembership(ctx, target, prevIndex, 0)
+}
+
 // Shutdown is used to stop the Raft background routines.
 // This is not a graceful operation. Provides a future that
 // can be used to block until all background routines have exited.
@@ -364,18 +823,162 @@ func (r *Raft) Shutdown() Future {
 	return &shutdownFuture{r}
 }
 
-// Snapshot is used to manually force Raft to take a snapshot.
-// Returns a future that can be used to block until complete.
-func (r *Raft) Snapshot() Future {
+// ShutdownGracefully is like Shutdown, but if this server is the leader, it
+// first hands off leadership so that the cluster isn't left without a leader
+// for an election timeout. The leader stops taking new log entries and
+// membership changes, which fail with ErrRaftShutdown, waits for its inflight
+// entries to commit, and then transfers leadership to the most up-to-date
+// voter before the background routines are stopped. If the hand-off fails, the
+// server shuts down anyway. If ctx is done before shutdown completes, the
+// server is shut down immediately and ctx.Err() is returned.
+func (r *Raft) ShutdownGracefully(ctx context.Context) error {
+	if r.protocolVersion >= 3 {
+		future := &leadershipTransferFuture{}
+		future.init()
+		select {
+		case r.channels.gracefulShutdownCh <- future:
+			// Errors here mean there was nothing to hand off or the hand-off
+			// failed; either way, carry on shutting down.
+			future.ErrorContext(ctx)
+		case <-r.channels.shutdownCh:
+		case <-ctx.Done():
+		}
+	}
+	shutdown := r.Shutdown()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrorContext(ctx, shutdown)
+}
+
+// Snapshot is used to manually force Raft to take a snapshot. Returns a future
+// that can be used to block until complete, and that contains a function that
+// can be used to open the snapshot, such as to make a backup.
+func (r *Raft) Snapshot() SnapshotFuture {
 	snapFuture := &snapshotFuture{}
 	snapFuture.init()
 	select {
 	case r.channels.snapshotCh <- snapFuture:
 		return snapFuture
+	case <-r.channels.shutdownCh:
+		snapFuture.respond(ErrRaftShutdown)
+		return snapFuture
+	}
+}
+
+// Restore is used to manually force Raft to consume an external snapshot, such
+// as if restoring from a backup. We will use the current Raft membership
+// configuration, not the one from the snapshot, so that we can restore into a
+// new cluster. We will also use the higher of the index of the snapshot, or
+// the current index, and then add 1 to that, so we force a new state with a
+// hole in the Raft log, so that the snapshot will be sent to followers and
+// used for any new joiners. This can only be run on the leader, and blocks
+// until the restore is complete and the followers have caught up with it.
+//
+// Inflight log entries that haven't been committed when the restore starts
+// fail with ErrAbortedByRestore. An optional timeout can be provided to limit
+// the amount of time we wait for the restore to be started.
+func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Duration) error {
+	r.metrics.IncrCounter([]string{"raft", "restore"}, 1)
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	// Perform the restore.
+	restore := &userRestoreFuture{
+		meta:   meta,
+		reader: reader,
+	}
+	restore.shutdownCh = r.channels.shutdownCh
+	restore.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.channels.shutdownCh:
+		return ErrRaftShutdown
+	case r.channels.restoreCh <- restore:
+		if err := restore.Error(); err != nil {
+			return err
+		}
+	}
+
+	// Apply a no-op log entry. Waiting for this allows us to wait until the
+	// followers have gotten the restore and replicated at least this new
+	// entry, which shows that they've also installed the snapshot with the
+	// contents of the restore.
+	noop := &logFuture{
+		log: Log{
+			Type: LogNoop,
+		},
+	}
+	noop.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.channels.shutdownCh:
+		return ErrRaftShutdown
+	case r.channels.applyCh <- noop:
+		return noop.Error()
+	}
+}
+
+// LeadershipTransfer will transfer leadership to the most up-to-date voter in
+// the cluster. This must be run on the leader or it will fail. While the
+// transfer is in progress, the leader rejects new log entries and membership
+// changes with ErrLeadershipTransferInProgress. The returned future succeeds
+// once this server has stepped down, or fails if the target hasn't taken over
+// within an election timeout, after which this server resumes normal
+// operation as leader.
+func (r *Raft) LeadershipTransfer() Future {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.initiateLeadershipTransfer("", "")
+}
+
+// LeadershipTransferToServer is like LeadershipTransfer but hands off
+// leadership to the given server, which must be a voter in the latest
+// membership configuration.
+func (r *Raft) LeadershipTransferToServer(id ServerID, address ServerAddress) Future {
+	if r.protocolVersion < 3 {
+		return errorFuture{ErrUnsupportedProtocol}
+	}
+
+	return r.initiateLeadershipTransfer(id, address)
+}
+
+// initiateLeadershipTransfer is a helper for LeadershipTransfer and
+// LeadershipTransferToServer. An empty id lets the leader pick the target.
+func (r *Raft) initiateLeadershipTransfer(id ServerID, address ServerAddress) Future {
+	future := &leadershipTransferFuture{
+		ID:      id,
+		Address: address,
+	}
+	future.init()
+	select {
+	case r.channels.leadershipTransferCh <- future:
+		return future
 	case <-r.channels.shutdownCh:
 		return errorFuture{ErrRaftShutdown}
 	}
+}
+
+// Leader is used to return the current leader of the cluster. It may return
+// an empty ServerAddress if there is no current leader or the leader is
+// unknown. Unlike Stats, this does not need a round trip through the main
+// thread, so it's cheap enough to call on every client request.
+func (r *Raft) Leader() ServerAddress {
+	addr, _ := r.shared.getLeader()
+	return addr
+}
 
+// LeaderWithID is like Leader but also returns the ServerID of the current
+// leader. The ID is empty if the leader is unknown or if its address could not
+// be found in the latest membership configuration.
+func (r *Raft) LeaderWithID() (ServerAddress, ServerID) {
+	return r.shared.getLeader()
 }
 
 // LeaderCh is used to get a channel which delivers signals on
@@ -437,6 +1040,28 @@ type Stats struct {
 	ProtocolVersionMax ProtocolVersion
 	SnapshotVersionMin SnapshotVersion
 	SnapshotVersionMax SnapshotVersion
+	// Peers describes replication to each other server in the latest
+	// membership, sorted by ID. Only populated on the leader.
+	Peers []PeerStats
+}
+
+// PeerStats describes the leader's view of replication to a single peer.
+type PeerStats struct {
+	ID       ServerID
+	Address  ServerAddress
+	Suffrage ServerSuffrage
+	// MatchIndex is the last index known to be replicated to the peer.
+	MatchIndex Index
+	// NextIndex is the next index the leader will send to the peer.
+	NextIndex Index
+	// Lag is how many entries the peer's MatchIndex is behind the leader's
+	// last log index.
+	Lag uint64
+	// LastContact is a lower bound on when the peer last heard from the
+	// leader. Zero if it never has.
+	LastContact time.Time
+	// InstallingSnapshot is set while a snapshot is being sent to the peer.
+	InstallingSnapshot bool
 }
 
 // Stringify a Stats struct into key-value strings.
@@ -457,7 +1082,7 @@ func (s *Stats) Strings() []struct{ K, V string } {
 	} else {
 		lastContact = fmt.Sprintf("%v", time.Now().Sub(s.LastContact))
 	}
-	return []struct{ K, V string }{
+	kvs := []struct{ K, V string }{
 		{"server_id", string(s.ServerID)},
 		{"server_address", string(s.ServerAddress)},
 		{"state", s.State.String()},
@@ -480,6 +1105,19 @@ func (s *Stats) Strings() []struct{ K, V string } {
 		{"snapshot_version_min", toString(uint64(s.SnapshotVersionMin))},
 		{"snapshot_version_max", toString(uint64(s.SnapshotVersionMax))},
 	}
+	for _, peer := range s.Peers {
+		peerContact := "never"
+		if !peer.LastContact.IsZero() {
+			peerContact = fmt.Sprintf("%v", time.Now().Sub(peer.LastContact))
+		}
+		kvs = append(kvs, struct{ K, V string }{
+			"peer:" + string(peer.ID),
+			fmt.Sprintf("address=%v suffrage=%v match_index=%v next_index=%v lag=%v last_contact=%v installing_snapshot=%v",
+				peer.Address, peer.Suffrage, peer.MatchIndex, peer.NextIndex,
+				peer.Lag, peerContact, peer.InstallingSnapshot),
+		})
+	}
+	return kvs
 }
 
 func (s *Stats) String() string {
@@ -2,9 +2,59 @@ package raft
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
 )
 
+// recordingMetrics is a Metrics that counts what it's given.
+type recordingMetrics struct {
+	sync.Mutex
+	counters map[string]float32
+	samples  map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		counters: make(map[string]float32),
+		samples:  make(map[string]int),
+	}
+}
+
+func (m *recordingMetrics) IncrCounter(key []string, val float32, labels ...metrics.Label) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *recordingMetrics) SetGauge(key []string, val float32, labels ...metrics.Label) {
+}
+
+func (m *recordingMetrics) AddSample(key []string, val float32, labels ...metrics.Label) {
+	m.Lock()
+	defer m.Unlock()
+	m.samples[strings.Join(key, ".")]++
+}
+
+func (m *recordingMetrics) MeasureSince(key []string, start time.Time, labels ...metrics.Label) {
+	m.AddSample(key, 0, labels...)
+}
+
+func (m *recordingMetrics) counter(key string) float32 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[key]
+}
+
+func (m *recordingMetrics) sampleCount(key string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.samples[key]
+}
+
 func TestAPI_Stats(t *testing.T) {
 	c := MakeCluster(1, t, nil)
 	defer c.Close()
@@ -48,6 +98,96 @@ func TestAPI_Stats_membershipFormatting(t *testing.T) {
 	}
 }
 
+func TestAPI_Stats_peers(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	behind := c.Followers()[0]
+	behindID := behind.serverInternals.localID
+
+	if peers := c.getStats(behind).Peers; len(peers) != 0 {
+		c.FailNowf("expected no peer stats on a follower, got %v", peers)
+	}
+
+	// Leave one follower behind while the log grows.
+	c.Disconnect(behind.serverInternals.localAddr)
+	var future Future
+	for i := 0; i < 10; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	if err := future.Error(); err != nil {
+		c.FailNowf("apply err: %v", err)
+	}
+
+	limit := time.Now().Add(c.longstopTimeout)
+	for {
+		s := c.getStats(leader)
+		if len(s.Peers) != 2 {
+			c.FailNowf("expected 2 peer stats, got %v", s.Peers)
+		}
+		ok := true
+		for _, peer := range s.Peers {
+			if peer.ID == behindID {
+				ok = ok && peer.Lag >= 10 && peer.MatchIndex+10 <= s.LastLogIndex
+			} else {
+				ok = ok && peer.Lag == 0 && peer.MatchIndex == s.LastLogIndex &&
+					peer.NextIndex == s.LastLogIndex+1 && !peer.LastContact.IsZero()
+			}
+		}
+		if ok {
+			found := false
+			for _, kv := range s.Strings() {
+				if kv.K == "peer:"+string(behindID) {
+					found = true
+				}
+			}
+			if !found {
+				c.FailNowf("peer %v missing from Strings()", behindID)
+			}
+			return
+		}
+		if time.Now().After(limit) {
+			c.FailNowf("unexpected peer stats: %+v", s.Peers)
+		}
+		c.WaitEvent(commitTimeout)
+	}
+}
+
+func TestAPI_Metrics(t *testing.T) {
+	// Two servers in one process, each with its own metrics.
+	var recorders []*recordingMetrics
+	var clusters []*cluster
+	for i := 0; i < 2; i++ {
+		conf := inmemConfig(t)
+		rec := newRecordingMetrics()
+		conf.Metrics = rec
+		c := MakeCluster(1, t, conf)
+		defer c.Close()
+		recorders = append(recorders, rec)
+		clusters = append(clusters, c)
+	}
+
+	c := clusters[0]
+	leader := c.Leader()
+	for i := 0; i < 3; i++ {
+		if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+	}
+	if got := recorders[0].counter("raft.apply"); got != 3 {
+		c.FailNowf("expected raft.apply 3, got %v", got)
+	}
+	if got := recorders[0].counter("raft.state.leader"); got != 1 {
+		c.FailNowf("expected raft.state.leader 1, got %v", got)
+	}
+	if got := recorders[0].sampleCount("raft.fsm.apply"); got < 3 {
+		c.FailNowf("expected at least 3 raft.fsm.apply samples, got %v", got)
+	}
+	if got := recorders[1].counter("raft.apply"); got != 0 {
+		c.FailNowf("expected no raft.apply on the other server, got %v", got)
+	}
+}
+
 func TestAPI_String(t *testing.T) {
 	c := MakeCluster(1, t, nil)
 	defer c.Close()
@@ -59,3 +199,28 @@ func TestAPI_String(t *testing.T) {
 			expected, actual)
 	}
 }
+
+func TestAPI_Leader(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	expAddr := leader.serverInternals.localAddr
+	expID := leader.serverInternals.localID
+
+	limit := time.Now().Add(c.longstopTimeout)
+CHECK:
+	for _, r := range c.rafts {
+		addr, id := r.LeaderWithID()
+		if addr != expAddr || id != expID {
+			if time.Now().After(limit) {
+				c.FailNowf("%v sees leader %v (%v), expected %v (%v)",
+					r, addr, id, expAddr, expID)
+			}
+			c.WaitEvent(commitTimeout)
+			goto CHECK
+		}
+		if r.Leader() != expAddr {
+			c.FailNowf("Leader() returned %v, expected %v", r.Leader(), expAddr)
+		}
+	}
+}
@@ -3,15 +3,13 @@ package raft
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"sync"
 	"time"
-
-	metrics "github.com/armon/go-metrics"
-	log "github.com/mgutz/logxi/v1"
 )
 
 var (
@@ -61,6 +59,125 @@ type raftShared struct {
 	// Cache the latest log from LogStore
 	lastLogIndex Index
 	lastLogTerm  Term
+
+	// protects 2 next fields
+	leaderLock sync.RWMutex
+
+	// The current leader of the cluster, as last seen by the main thread.
+	leaderAddr ServerAddress
+	leaderID   ServerID
+
+	// protects 2 next fields
+	appliedLock sync.Mutex
+
+	// The index of the last entry applied to the FSM, or restored into it from
+	// a snapshot.
+	appliedIndex Index
+
+	// Closed and cleared when appliedIndex changes. Only created once someone
+	// needs to wait for it.
+	appliedCh chan struct{}
+
+	// protects 2 next fields
+	leaseLock sync.Mutex
+
+	// While leader with LeaseReads enabled, the time until which no other
+	// leader can have been elected, and the read index to use until then.
+	leaseExpiry time.Time
+	leaseIndex  Index
+
+	// protects next field
+	versionLock sync.Mutex
+
+	// The protocol version the main thread is speaking, which decides the
+	// version of new snapshots.
+	protocolVersion ProtocolVersion
+
+	// List of observers and the mutex that protects them. The observers list
+	// is indexed by an artificial ID which is used for deregistration.
+	observersLock sync.RWMutex
+	observers     map[uint64]*Observer
+}
+
+func (r *raftShared) getLeader() (addr ServerAddress, id ServerID) {
+	r.leaderLock.RLock()
+	addr = r.leaderAddr
+	id = r.leaderID
+	r.leaderLock.RUnlock()
+	return
+}
+
+func (r *raftShared) setLeader(addr ServerAddress, id ServerID) {
+	r.leaderLock.Lock()
+	r.leaderAddr = addr
+	r.leaderID = id
+	r.leaderLock.Unlock()
+}
+
+func (r *raftShared) getProtocolVersion() ProtocolVersion {
+	r.versionLock.Lock()
+	defer r.versionLock.Unlock()
+	return r.protocolVersion
+}
+
+func (r *raftShared) setProtocolVersion(version ProtocolVersion) {
+	r.versionLock.Lock()
+	r.protocolVersion = version
+	r.versionLock.Unlock()
+}
+
+func (r *raftShared) setApplied(index Index) {
+	r.appliedLock.Lock()
+	r.appliedIndex = index
+	if r.appliedCh != nil {
+		close(r.appliedCh)
+		r.appliedCh = nil
+	}
+	r.appliedLock.Unlock()
+}
+
+// waitApplied blocks until the FSM has applied the given index. It returns
+// early with an error if ctx is done or shutdownCh is closed.
+func (r *raftShared) waitApplied(ctx context.Context, index Index, shutdownCh <-chan struct{}) error {
+	for {
+		r.appliedLock.Lock()
+		if r.appliedIndex >= index {
+			r.appliedLock.Unlock()
+			return nil
+		}
+		if r.appliedCh == nil {
+			r.appliedCh = make(chan struct{})
+		}
+		appliedCh := r.appliedCh
+		r.appliedLock.Unlock()
+
+		select {
+		case <-appliedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-shutdownCh:
+			return ErrRaftShutdown
+		}
+	}
+}
+
+func (r *raftShared) setLease(expiry time.Time, index Index) {
+	r.leaseLock.Lock()
+	r.leaseExpiry = expiry
+	r.leaseIndex = index
+	r.leaseLock.Unlock()
+}
+
+// getLease returns the lease read index, or false if the lease has expired.
+func (r *raftShared) getLease() (Index, bool) {
+	r.leaseLock.Lock()
+	expiry := r.leaseExpiry
+	index := r.leaseIndex
+	r.leaseLock.Unlock()
+	if time.Now().Before(expiry) {
+		return index, true
+	}
+	return 0, false
 }
 
 func (r *raftShared) getLastLog() (index Index, term Term) {
@@ -117,13 +234,14 @@ func (r *raftShared) getLastEntry() (Index, Term) {
 
 // Raft implements a Raft node.
 type raftServer struct {
-	shared raftShared
+	shared *raftShared
 
 	// Tracks running goroutines
 	goRoutines *waitGroup
 
 	// protocolVersion is used to inter-operate with Raft servers running
-	// different versions of the library. See comments in config.go for more
+	// different versions of the library. It starts at the configured version
+	// and may be raised by negotiation. See comments in config.go for more
 	// details.
 	protocolVersion ProtocolVersion
 
@@ -164,8 +282,10 @@ type raftServer struct {
 	// leader node. This can be used to gauge staleness.
 	lastContact time.Time
 
-	// Leader is the current cluster leader
-	leader ServerAddress
+	// Leader is the current cluster leader. Use setLeader() to change it so
+	// that the copy in shared stays up to date.
+	leader   ServerAddress
+	leaderID ServerID
 
 	// leaderState used only while state is leader
 	leaderState leaderState
@@ -177,7 +297,10 @@ type raftServer struct {
 	localAddr ServerAddress
 
 	// Used for our logging
-	logger log.Logger
+	logger Logger
+
+	// Receives counters and timings. From Config.Metrics, or GlobalMetrics.
+	metrics Metrics
 
 	// LogStore provides durable storage for logs
 	logs LogStore
@@ -199,18 +322,26 @@ type raftServer struct {
 	// The transport layer we use
 	trans Transport
 
-	// List of observers and the mutex that protects them. The observers list
-	// is indexed by an artificial ID which is used for deregistration.
-	observerLock sync.RWMutex
-	observer     chan<- interface{}
-
 	// A monotonically increasing counter used for verifying the leader is current.
 	verifyCounter uint64
+
+	// Set while running an election that was started by a TimeoutNow RPC, so
+	// that voters disregard the leader they know about.
+	candidateFromLeadershipTransfer bool
+
+	// Set while a candidate is running a pre-vote round (see Config.PreVote).
+	// The term is only incremented once the pre-vote has been won.
+	preVoteInProgress bool
 }
 
 type raftPeer struct {
+	server    Server
 	controlCh chan<- peerControl
 	progress  peerProgress
+
+	// started is when replication to this peer started. Until the peer first
+	// answers, the leader lease counts this as its last contact.
+	started time.Time
 }
 
 // commitTuple is used to send an index that was committed,
@@ -232,19 +363,40 @@ type leaderState struct {
 	// (per Raft's commitment rule)
 	startIndex Index
 
+	// when this server became leader; replies to RPCs sent before then don't
+	// count towards the read lease
+	startTime time.Time
+
 	inflight      *list.List // list of logFuture in log index order
 	verifyBatches []verifyBatch
+
+	// The leadership transfer in progress, or nil. While this is set, new log
+	// entries and membership changes are rejected.
+	leadershipTransfer *leadershipTransferFuture
+	// Fires when the leadership transfer in progress should be abandoned.
+	leadershipTransferTimeout <-chan time.Time
+
+	// Set by ShutdownGracefully. While this is set, new log entries and
+	// membership changes are rejected; once the inflight entries have
+	// committed, it's used as the future for a leadership transfer.
+	draining *leadershipTransferFuture
+	// Set once the draining leadership transfer has been started.
+	drainingTransferStarted bool
+
+	// The ChangeMembership request whose joint configuration this leader
+	// appended, if any. It's answered once the final configuration commits.
+	jointChange *membershipChangeFuture
 }
 
 func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps SnapshotStore, trans Transport,
-	channels *apiChannels, goRoutines *waitGroup) (*raftServer, error) {
+	shared *raftShared, channels *apiChannels, goRoutines *waitGroup) (*raftServer, error) {
 	// Validate the configuration.
 	if err := ValidateConfig(conf); err != nil {
 		return nil, err
 	}
 
 	// Ensure we have a LogOutput.
-	var logger log.Logger
+	var logger Logger
 	if conf.Logger != nil {
 		logger = conf.Logger
 	} else {
@@ -254,6 +406,11 @@ func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, sna
 		logger = DefaultStdLogger(conf.LogOutput)
 	}
 
+	var metrics Metrics = GlobalMetrics{}
+	if conf.Metrics != nil {
+		metrics = conf.Metrics
+	}
+
 	// Try to restore the current term.
 	v, err := stable.GetUint64(keyCurrentTerm)
 	currentTerm := Term(v)
@@ -285,9 +442,11 @@ func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, sna
 	if protocolVersion < 3 && string(localID) != string(localAddr) {
 		return nil, fmt.Errorf("when running with ProtocolVersion < 3, LocalID must be set to the network address")
 	}
+	shared.setProtocolVersion(protocolVersion)
 
 	// Create Raft struct.
 	r := &raftServer{
+		shared:          shared,
 		protocolVersion: protocolVersion,
 		peerProgressCh:  make(chan peerProgress),
 		peers:           make(map[ServerID]*raftPeer),
@@ -300,6 +459,7 @@ func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, sna
 		localID:         localID,
 		localAddr:       localAddr,
 		logger:          logger,
+		metrics:         metrics,
 		logs:            logs,
 		memberships:     memberships{},
 		rpcCh:           trans.Consumer(),
@@ -316,7 +476,7 @@ func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, sna
 	// for testing purposes.
 	if conf.StartAsLeader {
 		r.setState(Leader)
-		r.leader = r.localAddr
+		r.setLeader(r.localAddr)
 	}
 
 	// Restore the current term and the last log.
@@ -334,7 +494,7 @@ func newRaftServer(conf *Config, fsm FSM, logs LogStore, stable StableStore, sna
 	for index := snapshotIndex + 1; index <= lastLog.Index; index++ {
 		var entry Log
 		if err := r.logs.GetLog(index, &entry); err != nil {
-			r.logger.Fatal("Failed to get log", "index", index, "error", err)
+			logFatal(r.logger, "Failed to get log", "index", index, "error", err)
 		}
 		r.processMembershipLogEntry(&entry)
 	}
@@ -391,6 +551,7 @@ func (r *raftServer) restoreSnapshot() error {
 
 		// Update the lastApplied so we don't replay old logs
 		r.lastApplied = snapshot.Index
+		r.shared.setApplied(snapshot.Index)
 
 		// Update the last stable snapshot info
 		r.shared.setLastSnapshot(snapshot.Index, snapshot.Term)
@@ -424,9 +585,7 @@ func (r *raftServer) restoreSnapshot() error {
 // Raft instance. This structure is sent along with RPC requests and
 // responses.
 func (r *raftServer) getRPCHeader() RPCHeader {
-	return RPCHeader{
-		ProtocolVersion: r.conf.ProtocolVersion,
-	}
+	return makeRPCHeader(r.protocolVersion)
 }
 
 // checkRPCHeader houses logic about whether this instance of Raft can process
@@ -467,7 +626,7 @@ func (r *raftServer) run() {
 		case <-r.api.shutdownCh:
 			// Clear the leader to prevent forwarding
 			r.state = Follower
-			r.leader = ""
+			r.setLeader("")
 			r.shutdownPeers()
 			return
 		default:
@@ -489,9 +648,9 @@ func (r *raftServer) run() {
 func (r *raftServer) runFollower() {
 	didWarn := false
 	r.logger.Info("Entering Follower state", "leader", r.leader)
-	metrics.IncrCounter([]string{"raft", "state", "follower"}, 1)
+	r.metrics.IncrCounter([]string{"raft", "state", "follower"}, 1)
 	heartbeatTimer := randomTimeout(r.conf.HeartbeatTimeout)
-	for {
+	for r.state == Follower {
 		select {
 		case rpc := <-r.rpcCh:
 			r.processRPC(rpc)
@@ -504,10 +663,28 @@ func (r *raftServer) runFollower() {
 			// Reject any operations since we are not the leader
 			a.respond(ErrNotLeader)
 
+		case b := <-r.api.applyBatchCh:
+			// Reject any operations since we are not the leader
+			for _, a := range b {
+				a.respond(ErrNotLeader)
+			}
+
 		case v := <-r.api.verifyCh:
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
 
+		case t := <-r.api.leadershipTransferCh:
+			// Reject any operations since we are not the leader
+			t.respond(ErrNotLeader)
+
+		case t := <-r.api.gracefulShutdownCh:
+			// Nothing to hand off since we are not the leader
+			t.respond(ErrNotLeader)
+
+		case u := <-r.api.restoreCh:
+			// Reject any restores since we are not the leader
+			u.respond(ErrNotLeader)
+
 		case c := <-r.api.membershipsCh:
 			c.memberships = r.memberships.Clone()
 			c.respond(nil)
@@ -530,7 +707,7 @@ func (r *raftServer) runFollower() {
 
 			// Heartbeat failed! Transition to the candidate state
 			lastLeader := r.leader
-			r.leader = ""
+			r.setLeader("")
 
 			if r.memberships.latestIndex == 0 {
 				if !didWarn {
@@ -547,7 +724,7 @@ func (r *raftServer) runFollower() {
 				r.logger.Warn("Heartbeat timeout reached, starting election",
 					"last_leader", lastLeader, "term", r.currentTerm,
 					"last_contact", r.lastContact)
-				metrics.IncrCounter([]string{"raft", "transition", "heartbeat_timeout"}, 1)
+				r.metrics.IncrCounter([]string{"raft", "transition", "heartbeat_timeout"}, 1)
 				r.setState(Candidate)
 				r.updatePeers()
 				return
@@ -573,7 +750,7 @@ func (r *raftServer) liveBootstrap(membership Membership) error {
 	// Make the configuration live.
 	var entry Log
 	if err := r.logs.GetLog(1, &entry); err != nil {
-		r.logger.Fatal("Could not read live-bootstrapped membership entry",
+		logFatal(r.logger, "Could not read live-bootstrapped membership entry",
 			"error", err)
 	}
 	r.currentTerm = 1
@@ -585,30 +762,35 @@ func (r *raftServer) liveBootstrap(membership Membership) error {
 
 // runCandidate runs the FSM for a candidate.
 func (r *raftServer) runCandidate() {
-	metrics.IncrCounter([]string{"raft", "state", "candidate"}, 1)
-	defer metrics.MeasureSince([]string{"raft", "candidate", "electSelf"}, time.Now())
+	r.metrics.IncrCounter([]string{"raft", "state", "candidate"}, 1)
+	defer r.metrics.MeasureSince([]string{"raft", "candidate", "electSelf"}, time.Now())
 
-	// Increment the term
-	r.currentTerm += 1
-	r.persistCurrentTerm()
-	r.logger.Info("Entering Candidate state", "term", r.currentTerm)
+	// A leadership transfer only applies to the first election round
+	defer func() {
+		r.candidateFromLeadershipTransfer = false
+		r.preVoteInProgress = false
+	}()
 
 	// Set a timeout
 	electionTimer := randomTimeout(r.conf.ElectionTimeout)
 
-	if hasVote(r.memberships.latest, r.localID) {
-		// Persist a vote for ourselves
-		err := r.persistVote(r.currentTerm, r.trans.EncodePeer(r.localAddr))
-		if err != nil {
-			r.logger.Error("Failed to persist vote", "error", err)
-			return // TODO: panic?
+	if r.conf.PreVote && !r.candidateFromLeadershipTransfer {
+		// Find out whether we could win before disrupting the cluster with a new
+		// term. There's no need when the leader has asked us to take over.
+		r.logger.Info("Entering Candidate state for pre-vote", "term", r.currentTerm+1)
+		r.preVoteInProgress = true
+		for _, peer := range r.peers {
+			peer.progress.preVoteGranted = false
 		}
-	}
-	r.computeCandidateProgress()
+		r.computeCandidateProgress()
 
-	// Ask peers to vote
-	r.updatePeers()
+		// Ask peers whether they would vote
+		r.updatePeers()
+	} else {
+		r.electSelf()
+	}
 
+	term := r.currentTerm
 	for r.state == Candidate {
 		select {
 		case rpc := <-r.rpcCh:
@@ -629,10 +811,28 @@ func (r *raftServer) runCandidate() {
 			// Reject any operations since we are not the leader
 			a.respond(ErrNotLeader)
 
+		case b := <-r.api.applyBatchCh:
+			// Reject any operations since we are not the leader
+			for _, a := range b {
+				a.respond(ErrNotLeader)
+			}
+
 		case v := <-r.api.verifyCh:
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
 
+		case t := <-r.api.leadershipTransferCh:
+			// Reject any operations since we are not the leader
+			t.respond(ErrNotLeader)
+
+		case t := <-r.api.gracefulShutdownCh:
+			// Nothing to hand off since we are not the leader
+			t.respond(ErrNotLeader)
+
+		case u := <-r.api.restoreCh:
+			// Reject any restores since we are not the leader
+			u.respond(ErrNotLeader)
+
 		case c := <-r.api.membershipsCh:
 			c.memberships = r.memberships.Clone()
 			c.respond(nil)
@@ -645,6 +845,14 @@ func (r *raftServer) runCandidate() {
 			b.respond(ErrCantBootstrap)
 
 		case <-electionTimer:
+			if r.preVoteInProgress {
+				// Pre-vote failed! Go back to waiting for a leader, which will
+				// kick us back into runCandidate after another heartbeat timeout
+				r.logger.Warn("Pre-vote timeout reached, returning to follower")
+				r.setState(Follower)
+				r.updatePeers()
+				return
+			}
 			// Election failed! Restart the election. We simply return,
 			// which will kick us back into runCandidate
 			r.logger.Warn("Election timeout reached, restarting election")
@@ -653,14 +861,45 @@ func (r *raftServer) runCandidate() {
 		case <-r.api.shutdownCh:
 			return
 		}
+
+		// Give the election a full timeout once the pre-vote has been won
+		if r.currentTerm != term {
+			term = r.currentTerm
+			electionTimer = randomTimeout(r.conf.ElectionTimeout)
+		}
 	}
 }
 
+// electSelf increments the term, votes for the local server, and asks peers
+// for their votes. This must only be called from the main thread while
+// candidate.
+func (r *raftServer) electSelf() {
+	// Increment the term
+	r.currentTerm += 1
+	r.logger.Info("Entering Candidate state", "term", r.currentTerm)
+
+	if hasVote(r.memberships.latest, r.localID) {
+		// Persist the new term along with a vote for ourselves
+		err := r.persistVote(r.currentTerm, r.trans.EncodePeer(r.localAddr))
+		if err != nil {
+			r.logger.Error("Failed to persist vote", "error", err)
+			r.persistCurrentTerm()
+			return // TODO: panic?
+		}
+	} else {
+		r.persistCurrentTerm()
+	}
+	r.computeCandidateProgress()
+
+	// Ask peers to vote
+	r.updatePeers()
+}
+
 // runLeader runs the FSM for a leader. Do the setup here and drop into
 // the leaderLoop for the hot loop.
 func (r *raftServer) runLeader() {
 	r.logger.Info("Entering Leader state")
-	metrics.IncrCounter([]string{"raft", "state", "leader"}, 1)
+	r.metrics.IncrCounter([]string{"raft", "state", "leader"}, 1)
 
 	// Notify that we are the leader
 	select {
@@ -679,6 +918,7 @@ func (r *raftServer) runLeader() {
 	// Setup leader state
 	// first index that may be committed in this term
 	r.leaderState.startIndex = r.shared.getLastIndex() + 1
+	r.leaderState.startTime = time.Now()
 	r.leaderState.inflight = list.New()
 	r.leaderState.verifyBatches = nil
 
@@ -694,6 +934,9 @@ func (r *raftServer) runLeader() {
 		// is extremely stale.
 		r.lastContact = time.Now()
 
+		// Give up the read lease
+		r.shared.setLease(time.Time{}, 0)
+
 		// Stop replication
 		r.updatePeers()
 
@@ -709,16 +952,47 @@ func (r *raftServer) runLeader() {
 			}
 		}
 
+		// A leadership transfer in progress has done its job once we've
+		// stepped down, regardless of who wins the next election
+		if r.leaderState.leadershipTransfer != nil {
+			if r.state == Leader {
+				r.leaderState.leadershipTransfer.respond(ErrRaftShutdown)
+			} else {
+				r.leaderState.leadershipTransfer.respond(nil)
+			}
+		}
+
+		// Likewise for a graceful shutdown whose leadership transfer hasn't
+		// started yet
+		if r.leaderState.draining != nil && !r.leaderState.drainingTransferStarted {
+			if r.state == Leader {
+				r.leaderState.draining.respond(ErrRaftShutdown)
+			} else {
+				r.leaderState.draining.respond(nil)
+			}
+		}
+
+		// Likewise for a joint membership change that hasn't reached its
+		// final configuration
+		if r.leaderState.jointChange != nil {
+			r.leaderState.jointChange.respond(ErrLeadershipLost)
+		}
+
 		// Clear all the state
 		r.leaderState.startIndex = 0
 		r.leaderState.inflight = nil
 		r.leaderState.verifyBatches = nil
+		r.leaderState.leadershipTransfer = nil
+		r.leaderState.leadershipTransferTimeout = nil
+		r.leaderState.draining = nil
+		r.leaderState.drainingTransferStarted = false
+		r.leaderState.jointChange = nil
 
 		// If we are stepping down for some reason, no known leader.
 		// We may have stepped down due to an RPC call, which would
 		// provide the leader, so we cannot always blank this out.
 		if r.leader == r.localAddr {
-			r.leader = ""
+			r.setLeader("")
 		}
 
 		// Notify that we are not the leader
@@ -762,30 +1036,50 @@ func (r *raftServer) runLeader() {
 // existing peers updated control information, and stop communication with
 // removed peers. This must only be called from the main thread.
 func (r *raftServer) updatePeers() {
-	inConfig := make(map[ServerID]Server, len(r.memberships.latest.Servers))
+	servers := r.memberships.latest.allServers()
+	inConfig := make(map[ServerID]Server, len(servers))
 
 	// Start replication goroutines that need starting
-	for _, server := range r.memberships.latest.Servers {
+	for _, server := range servers {
 		if server.ID == r.localID {
 			continue
 		}
 		inConfig[server.ID] = server
+		if peer, ok := r.peers[server.ID]; ok && peer.server.Address != server.Address {
+			r.logger.Info("Peer address changed, restarting replication",
+				"id", server.ID, "from", peer.server.Address, "to", server.Address)
+			peer.controlCh <- peerControl{
+				term:     r.currentTerm,
+				role:     Follower,
+				shutdown: true,
+			}
+			delete(r.peers, server.ID)
+		}
 		if _, ok := r.peers[server.ID]; !ok {
 			r.logger.Info("Added peer, starting replication",
 				"id", server.ID, "address", server.Address)
 			controlCh := startPeer(server.ID, server.Address, r.logger, r.logs, r.snapshots,
-				r.goRoutines, r.trans, r.localAddr, ProtocolVersionMax,
+				r.goRoutines, r.trans, r.localAddr,
 				r.peerProgressCh, peerOptions{
 					maxAppendEntries:  uint64(r.conf.MaxAppendEntries),
 					heartbeatInterval: r.conf.HeartbeatTimeout / 5,
+					observe:           r.shared.observe,
+					metrics:           r.metrics,
 				})
 			peer := &raftPeer{
+				server:    server,
 				controlCh: controlCh,
+				started:   time.Now(),
 			}
 			r.peers[server.ID] = peer
+			r.observe(PeerObservation{Peer: server})
 		}
 	}
 
+	if r.state == Leader {
+		r.negotiateProtocolVersion()
+	}
+
 	// Send new control information and stop Peer goroutines that need stopping
 	lastIndex, lastTerm := r.shared.getLastEntry()
 	for serverID, peer := range r.peers {
@@ -795,9 +1089,10 @@ func (r *raftServer) updatePeers() {
 		server, ok := inConfig[serverID]
 		if !ok {
 			r.logger.Info("Removed peer, stopping communication",
-				"id", serverID, "address", server.Address)
+				"id", serverID, "address", peer.server.Address)
 			delete(r.peers, serverID)
 			shutdown = true
+			r.observe(PeerObservation{Removed: true, Peer: peer.server})
 		} else {
 			if server.Suffrage != Voter {
 				if role == Candidate {
@@ -806,19 +1101,73 @@ func (r *raftServer) updatePeers() {
 				verifyCounter = 0
 			}
 		}
+		leadershipTransfer := false
+		switch role {
+		case Candidate:
+			leadershipTransfer = r.candidateFromLeadershipTransfer
+		case Leader:
+			leadershipTransfer = r.leaderState.leadershipTransfer != nil &&
+				r.leaderState.leadershipTransfer.ID == serverID
+		}
 		control := peerControl{
-			term:          r.currentTerm,
-			role:          role,
-			shutdown:      shutdown,
-			verifyCounter: verifyCounter,
-			lastIndex:     lastIndex,
-			lastTerm:      lastTerm,
-			commitIndex:   r.commitIndex,
+			term:               r.currentTerm,
+			role:               role,
+			shutdown:           shutdown,
+			verifyCounter:      verifyCounter,
+			lastIndex:          lastIndex,
+			lastTerm:           lastTerm,
+			commitIndex:        r.commitIndex,
+			leadershipTransfer: leadershipTransfer,
+			preVote:            role == Candidate && r.preVoteInProgress,
+			protocolVersion:    r.protocolVersion,
 		}
 		peer.controlCh <- control
 	}
 }
 
+// negotiateProtocolVersion picks the protocol version to speak as leader: the
+// newest one every member of the latest membership understands, but never
+// older than the configured ProtocolVersion. Members that haven't replied yet
+// are assumed to understand only the configured version. Versions before 3
+// change how servers are identified, so they're never negotiated. Returns true
+// if the version changed. This must only be called from the main thread while
+// leader.
+func (r *raftServer) negotiateProtocolVersion() bool {
+	if r.conf.ProtocolVersion < 3 {
+		return false
+	}
+	version := ProtocolVersion(ProtocolVersionMax)
+	for _, server := range r.memberships.latest.allServers() {
+		if server.ID == r.localID {
+			continue
+		}
+		max := r.conf.ProtocolVersion
+		if peer, ok := r.peers[server.ID]; ok && peer.progress.protocolVersionMax > 0 {
+			max = peer.progress.protocolVersionMax
+		}
+		if max < version {
+			version = max
+		}
+	}
+	if version < r.conf.ProtocolVersion {
+		version = r.conf.ProtocolVersion
+	}
+	if version == r.protocolVersion {
+		return false
+	}
+	r.setProtocolVersion(version)
+	return true
+}
+
+// setProtocolVersion changes the protocol version this server speaks. This
+// must only be called from the main thread.
+func (r *raftServer) setProtocolVersion(version ProtocolVersion) {
+	r.logger.Info("Changing protocol version",
+		"from", r.protocolVersion, "to", version)
+	r.protocolVersion = version
+	r.shared.setProtocolVersion(version)
+}
+
 // shutdownPeers instructs all peers to exit immediately.
 func (r *raftServer) shutdownPeers() {
 	control := peerControl{
@@ -865,6 +1214,14 @@ func (r *raftServer) leaderLoop() {
 
 	lease := time.After(r.conf.LeaderLeaseTimeout)
 	for r.state == Leader {
+		// Once a graceful shutdown has drained the inflight entries, hand off
+		// leadership.
+		if r.leaderState.draining != nil && !r.leaderState.drainingTransferStarted &&
+			r.leaderState.leadershipTransfer == nil && r.leaderState.inflight.Len() == 0 {
+			r.leaderState.drainingTransferStarted = true
+			r.startLeadershipTransfer(r.leaderState.draining)
+		}
+
 		select {
 		case rpc := <-r.rpcCh:
 			r.processRPC(rpc)
@@ -883,14 +1240,62 @@ func (r *raftServer) leaderLoop() {
 					drained = true
 				}
 			}
-			r.verifyLeader(futures)
+			// Drop the requests that their callers have given up on.
+			n := 0
+			readIndex := r.readIndex()
+			for _, f := range futures {
+				if !f.cancelled() {
+					f.index = readIndex
+					futures[n] = f
+					n++
+				}
+			}
+			if n > 0 {
+				r.verifyLeader(futures[:n])
+			}
 
 		case c := <-r.api.membershipsCh:
 			c.memberships = r.memberships.Clone()
 			c.respond(nil)
 
 		case future := <-r.membershipChangeChIfStable():
-			r.appendMembershipEntry(future)
+			if r.leaderState.draining != nil {
+				future.respond(ErrRaftShutdown)
+			} else if r.leaderState.leadershipTransfer != nil {
+				future.respond(ErrLeadershipTransferInProgress)
+			} else if !future.cancelled() {
+				r.appendMembershipEntry(future)
+			}
+
+		case future := <-r.api.leadershipTransferCh:
+			r.startLeadershipTransfer(future)
+
+		case future := <-r.api.gracefulShutdownCh:
+			if r.leaderState.draining != nil {
+				future.respond(ErrRaftShutdown)
+			} else {
+				r.logger.Info("Shutting down gracefully, draining inflight entries",
+					"inflight", r.leaderState.inflight.Len())
+				r.leaderState.draining = future
+			}
+
+		case future := <-r.api.restoreCh:
+			if r.leaderState.draining != nil {
+				future.respond(ErrRaftShutdown)
+			} else if r.leaderState.leadershipTransfer != nil {
+				future.respond(ErrLeadershipTransferInProgress)
+			} else {
+				future.respond(r.restoreUserSnapshot(future.meta, future.reader))
+			}
+
+		case <-r.leaderState.leadershipTransferTimeout:
+			r.logger.Warn("Leadership transfer timed out, resuming as leader",
+				"id", r.leaderState.leadershipTransfer.ID,
+				"address", r.leaderState.leadershipTransfer.Address)
+			r.leaderState.leadershipTransfer.respond(fmt.Errorf("leadership transfer timeout"))
+			r.leaderState.leadershipTransfer = nil
+			r.leaderState.leadershipTransferTimeout = nil
+			r.updatePeers()
 
 		case f := <-r.api.statsCh:
 			f.stats = r.stats()
@@ -911,15 +1316,13 @@ func (r *raftServer) leaderLoop() {
 				}
 			}
 
-			// Dispatch the logs
-			if stepDown {
-				// we're in the process of stepping down as leader, don't process anything new
-				for i := range ready {
-					ready[i].respond(ErrNotLeader)
-				}
-			} else {
-				r.dispatchLogs(ready)
-			}
+			r.dispatchReady(ready, stepDown)
+
+		case batch := <-r.api.applyBatchCh:
+			// Keep the batch together so its entries get contiguous indexes.
+			// The caller's batchFuture still reads the slice, so dispatch a
+			// copy that can be filtered in place.
+			r.dispatchReady(append([]*logFuture(nil), batch...), stepDown)
 
 		case <-lease:
 			// Check if we've exceeded the lease, potentially stepping down
@@ -932,6 +1335,9 @@ func (r *raftServer) leaderLoop() {
 			if ok {
 				peer.progress = progress
 				r.computeLeaderProgress()
+				if r.state == Leader && r.negotiateProtocolVersion() {
+					r.updatePeers()
+				}
 			}
 
 		case <-r.api.shutdownCh:
@@ -941,12 +1347,202 @@ func (r *raftServer) leaderLoop() {
 	}
 }
 
+// dispatchReady dispatches the log futures gathered by the leader loop, unless
+// it's not taking new entries. This must only be called from the main thread
+// while leader.
+func (r *raftServer) dispatchReady(ready []*logFuture, stepDown bool) {
+	if stepDown {
+		// we're in the process of stepping down as leader, don't process anything new
+		for i := range ready {
+			ready[i].respond(ErrNotLeader)
+		}
+	} else if r.leaderState.draining != nil {
+		// we're shutting down, don't process anything new
+		for i := range ready {
+			ready[i].respond(ErrRaftShutdown)
+		}
+	} else if r.leaderState.leadershipTransfer != nil {
+		// we're handing off leadership, don't process anything new
+		for i := range ready {
+			ready[i].respond(ErrLeadershipTransferInProgress)
+		}
+	} else {
+		// drop the entries that their callers have given up on
+		n := 0
+		for _, f := range ready {
+			if !f.cancelled() {
+				ready[n] = f
+				n++
+			}
+		}
+		if n > 0 {
+			r.dispatchLogs(ready[:n])
+		}
+	}
+}
+
+// startLeadershipTransfer picks the target of a leadership transfer, then has
+// its Peer send it a TimeoutNow RPC once it has caught up with our log. This
+// must only be called from the main thread while leader.
+func (r *raftServer) startLeadershipTransfer(future *leadershipTransferFuture) {
+	if r.leaderState.leadershipTransfer != nil {
+		future.respond(ErrLeadershipTransferInProgress)
+		return
+	}
+
+	if future.ID == "" {
+		// Pick the voter that has acknowledged the most of our log.
+		var bestMatch Index
+		for _, server := range r.memberships.latest.Servers {
+			if server.ID == r.localID || server.Suffrage != Voter {
+				continue
+			}
+			peer, ok := r.peers[server.ID]
+			if !ok {
+				continue
+			}
+			if future.ID == "" || peer.progress.matchIndex > bestMatch {
+				future.ID = server.ID
+				future.Address = server.Address
+				bestMatch = peer.progress.matchIndex
+			}
+		}
+		if future.ID == "" {
+			future.respond(fmt.Errorf("no voter to transfer leadership to"))
+			return
+		}
+	} else {
+		found := false
+		for _, server := range r.memberships.latest.Servers {
+			if server.ID == future.ID {
+				found = server.Suffrage == Voter && server.ID != r.localID
+				if future.Address != "" && future.Address != server.Address {
+					found = false
+				}
+				future.Address = server.Address
+				break
+			}
+		}
+		if !found {
+			future.respond(fmt.Errorf("cannot transfer leadership to %v: not a voter in the latest membership",
+				future.ID))
+			return
+		}
+	}
+
+	r.logger.Info("Starting leadership transfer",
+		"id", future.ID, "address", future.Address)
+	r.metrics.IncrCounter([]string{"raft", "leader", "leadershipTransfer"}, 1)
+	r.leaderState.leadershipTransfer = future
+	r.leaderState.leadershipTransferTimeout = time.After(r.conf.ElectionTimeout)
+	r.updateLease()
+	r.updatePeers()
+}
+
+// restoreUserSnapshot is used to manually consume an external snapshot, such
+// as if restoring from a backup. We will use the current Raft membership
+// configuration, not the one from the snapshot, so that we can restore into a
+// new cluster. We will also use the higher of the index of the snapshot, or
+// the current index, and then add 1 to that, so we force a new state with a
+// hole in the Raft log, so that the snapshot will be sent to followers and
+// used for any new joiners. This must only be called from the main thread
+// while leader.
+func (r *raftServer) restoreUserSnapshot(meta *SnapshotMeta, reader io.Reader) error {
+	defer r.metrics.MeasureSince([]string{"raft", "restoreUserSnapshot"}, time.Now())
+
+	// Sanity check the version.
+	version := meta.Version
+	if version < SnapshotVersionMin || version > SnapshotVersionMax {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	// We don't support snapshots while there's a membership change
+	// outstanding since the snapshot doesn't have a means to represent this
+	// state.
+	committedIndex := r.memberships.committedIndex
+	latestIndex := r.memberships.latestIndex
+	if committedIndex != latestIndex {
+		return fmt.Errorf("cannot restore snapshot now, wait until the membership entry at %v has been applied (have applied %v)",
+			latestIndex, committedIndex)
+	}
+
+	// Cancel any inflight requests.
+	for {
+		e := r.leaderState.inflight.Front()
+		if e == nil {
+			break
+		}
+		e.Value.(*logFuture).respond(ErrAbortedByRestore)
+		r.leaderState.inflight.Remove(e)
+	}
+
+	// We will overwrite the snapshot metadata with the current term, an index
+	// that's greater than the current index, or the last index in the
+	// snapshot. It's important that we leave a hole in the index so we know
+	// there's nothing in the Raft log there and replication will fault and
+	// send the snapshot.
+	term := r.currentTerm
+	lastIndex := r.shared.getLastIndex()
+	if meta.Index > lastIndex {
+		lastIndex = meta.Index
+	}
+	lastIndex++
+
+	// Dump the snapshot. Note that we use the latest membership
+	// configuration and not the one that came with the snapshot.
+	sink, err := r.snapshots.Create(version, lastIndex, term,
+		r.memberships.latest, r.memberships.latestIndex, r.trans)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	n, err := io.Copy(sink, reader)
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if n != meta.Size {
+		sink.Cancel()
+		return fmt.Errorf("failed to write snapshot, size didn't match (%d != %d)", n, meta.Size)
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %v", err)
+	}
+	r.logger.Info("Copied to local snapshot", "bytes", n)
+
+	// Restore the snapshot into the FSM. If this fails we are in a
+	// bad state so we panic to take ourselves out.
+	fsm := &restoreFuture{ID: sink.ID()}
+	fsm.init()
+	select {
+	case r.fsmRestoreCh <- fsm:
+	case <-r.api.shutdownCh:
+		return ErrRaftShutdown
+	}
+	if err := fsm.Error(); err != nil {
+		panic(fmt.Errorf("failed to restore snapshot: %v", err))
+	}
+
+	// The last applied index and the last snapshot are set because we made
+	// this snapshot, so we don't want to replay old logs.
+	r.lastApplied = lastIndex
+	r.shared.setLastSnapshot(lastIndex, term)
+
+	// Let the peers find out about the new snapshot.
+	r.updatePeers()
+
+	r.logger.Info("Restored user snapshot", "index", lastIndex)
+	return nil
+}
+
 func (r *raftServer) updateCommitIndex(oldCommitIndex, commitIndex Index) {
 	r.logger.Debug("New commit index",
 		"old_index", oldCommitIndex,
 		"new_index", commitIndex)
 	stepDown := false
 	r.commitIndex = commitIndex
+	// Publish the new read index before the FSM can apply anything, so that
+	// lease reads never lag behind a completed Apply.
+	r.updateLease()
 	// Process the newly committed entries
 	if r.memberships.latestIndex > oldCommitIndex &&
 		r.memberships.latestIndex <= commitIndex {
@@ -968,7 +1564,7 @@ func (r *raftServer) updateCommitIndex(oldCommitIndex, commitIndex Index) {
 			break
 		}
 		// Measure the commit time
-		metrics.MeasureSince([]string{"raft", "commitTime"}, commitLog.dispatch)
+		r.metrics.MeasureSince([]string{"raft", "commitTime"}, commitLog.dispatch)
 		r.processLogs(idx, commitLog)
 		r.leaderState.inflight.Remove(e)
 	}
@@ -981,11 +1577,33 @@ func (r *raftServer) updateCommitIndex(oldCommitIndex, commitIndex Index) {
 			r.logger.Info("Removed ourself, transitioning to follower")
 		}
 		r.stepDown()
+	} else {
+		r.leaveJointMembership()
 	}
 
 	r.updatePeers()
 }
 
+// leaveJointMembership appends the final configuration of a joint membership
+// change once the joint configuration has committed. A new leader also
+// finishes changes started by its predecessor, once it's committed an entry
+// of its own. This must only be called from the main thread while leader.
+func (r *raftServer) leaveJointMembership() {
+	if !r.memberships.latest.joint() ||
+		r.memberships.latestIndex != r.memberships.committedIndex ||
+		r.commitIndex < r.leaderState.startIndex {
+		return
+	}
+	future := r.leaderState.jointChange
+	r.leaderState.jointChange = nil
+	if future == nil {
+		future = &membershipChangeFuture{}
+		future.init()
+	}
+	future.req = membershipChangeRequest{command: LeaveJoint}
+	r.appendMembershipEntry(future)
+}
+
 // Responds to any verify futures that have been satisfied. A majority of the
 // voting servers in the cluster have acknowledged this server's leadership
 // since the given 'count'.
@@ -1008,47 +1626,47 @@ func (r *raftServer) verified(count uint64) {
 }
 
 func (r *raftServer) computeCandidateProgress() {
-	servers := len(r.memberships.latest.Servers)
-	votes := make([]uint64, 0, servers)
-	if hasVote(r.memberships.latest, r.localID) {
-		votes = append(votes, 1)
-	}
+	// Only granted votes are recorded; quorumGeq counts the rest as 0 and
+	// ignores servers without a vote.
+	votes := make(map[ServerID]uint64, len(r.peers)+1)
+	votes[r.localID] = 1
 	for peerID, peer := range r.peers {
 		switch {
 		case peer.progress.term > r.currentTerm:
 			r.logger.Debug("Newer term discovered, fallback to follower")
 			r.updateTerm(peer.progress.term)
 			return
-		case peer.progress.term == r.currentTerm:
-			if hasVote(r.memberships.latest, peerID) {
-				if peer.progress.voteGranted {
-					votes = append(votes, 1)
-				} else {
-					votes = append(votes, 0)
-				}
+		case r.preVoteInProgress:
+			// Peers answer pre-votes with their own term, which may be behind.
+			if peer.progress.preVoteGranted {
+				votes[peerID] = 1
 			}
-		case peer.progress.term < r.currentTerm:
-			if hasVote(r.memberships.latest, peerID) {
-				votes = append(votes, 0)
+		case peer.progress.term == r.currentTerm:
+			if peer.progress.voteGranted {
+				votes[peerID] = 1
 			}
 		}
 	}
-	if quorumGeq(votes) == 1 {
-		r.logger.Info("Election won", "tally", sum(votes))
+	won := r.memberships.latest.quorumGeq(votes) == 1
+	if won && r.preVoteInProgress {
+		r.logger.Info("Pre-vote won, starting election", "tally", len(votes))
+		r.preVoteInProgress = false
+		r.electSelf()
+	} else if won {
+		r.logger.Info("Election won", "tally", len(votes))
 		r.setState(Leader)
-		r.leader = r.localAddr
+		r.setLeader(r.localAddr)
 		r.updatePeers()
 	}
 }
 
 func (r *raftServer) computeLeaderProgress() {
-	servers := len(r.memberships.latest.Servers)
-	verifiedCounters := make([]uint64, 0, servers)
-	matchIndexes := make([]uint64, 0, servers)
-	if hasVote(r.memberships.latest, r.localID) {
-		verifiedCounters = append(verifiedCounters, r.verifyCounter)
-		matchIndexes = append(matchIndexes, uint64(r.shared.getLastIndex()))
-	}
+	// Peers behind our term count as 0; quorumGeq ignores servers without a
+	// vote.
+	verifiedCounters := make(map[ServerID]uint64, len(r.peers)+1)
+	matchIndexes := make(map[ServerID]uint64, len(r.peers)+1)
+	verifiedCounters[r.localID] = r.verifyCounter
+	matchIndexes[r.localID] = uint64(r.shared.getLastIndex())
 	for peerID, peer := range r.peers {
 		switch {
 		case peer.progress.term > r.currentTerm:
@@ -1056,25 +1674,19 @@ func (r *raftServer) computeLeaderProgress() {
 			r.updateTerm(peer.progress.term)
 			return
 		case peer.progress.term == r.currentTerm:
-			if hasVote(r.memberships.latest, peerID) {
-				verifiedCounters = append(verifiedCounters, peer.progress.verifiedCounter)
-				matchIndexes = append(matchIndexes, uint64(peer.progress.matchIndex))
-			}
-		case peer.progress.term < r.currentTerm:
-			if hasVote(r.memberships.latest, peerID) {
-				verifiedCounters = append(verifiedCounters, 0)
-				matchIndexes = append(matchIndexes, 0)
-			}
+			verifiedCounters[peerID] = peer.progress.verifiedCounter
+			matchIndexes[peerID] = uint64(peer.progress.matchIndex)
 		}
 	}
-	verifiedCounter := quorumGeq(verifiedCounters)
-	matchIndex := Index(quorumGeq(matchIndexes))
+	verifiedCounter := r.memberships.latest.quorumGeq(verifiedCounters)
+	matchIndex := Index(r.memberships.latest.quorumGeq(matchIndexes))
 
 	oldCommitIndex := r.commitIndex
 	if matchIndex > oldCommitIndex && matchIndex >= r.leaderState.startIndex {
 		r.updateCommitIndex(oldCommitIndex, matchIndex)
 	}
 	r.verified(verifiedCounter)
+	r.updateLease()
 }
 
 // Internal helper to calculate new commitIndex from matchIndexes,
@@ -1087,14 +1699,6 @@ func quorumGeq(values []uint64) uint64 {
 	return values[(len(values)-1)/2]
 }
 
-func sum(values []uint64) uint64 {
-	var total uint64
-	for _, v := range values {
-		total += v
-	}
-	return total
-}
-
 // verifyLeader must be called from the main thread for safety.
 // Causes the followers to attempt an immediate heartbeat.
 func (r *raftServer) verifyLeader(futures []*verifyFuture) {
@@ -1115,36 +1719,88 @@ func (r *raftServer) verifyLeader(futures []*verifyFuture) {
 	r.computeLeaderProgress()
 }
 
+// readIndex returns the index that a linearizable read must wait to have
+// applied, assuming leadership is then verified. This is the commit index, but
+// no earlier than the first entry of this leader's term: until that entry is
+// committed, this leader may not know everything that was committed before.
+// This must only be called from the main thread while leader.
+func (r *raftServer) readIndex() Index {
+	if r.commitIndex < r.leaderState.startIndex {
+		return r.leaderState.startIndex
+	}
+	return r.commitIndex
+}
+
+// quorumLastContact returns the latest time by which a quorum of voters,
+// counting ourselves as of now, had answered an RPC from us. Replies to RPCs
+// sent before notBefore are ignored. Peers that have never answered are
+// ignored too, except that with a zero notBefore they count as contacted when
+// replication to them started. This must only be called from the main thread.
+func (r *raftServer) quorumLastContact(notBefore time.Time) time.Time {
+	lastContacts := make(map[ServerID]uint64, len(r.peers)+1)
+	lastContacts[r.localID] = uint64(time.Now().UnixNano())
+	for peerID, peer := range r.peers {
+		lastContact := peer.progress.lastContact
+		if lastContact.IsZero() && notBefore.IsZero() {
+			lastContact = peer.started
+		}
+		if !lastContact.IsZero() && !lastContact.Before(notBefore) {
+			lastContacts[peerID] = uint64(lastContact.UnixNano())
+		}
+	}
+	lastContactUnix := r.memberships.latest.quorumGeq(lastContacts)
+	return time.Unix(int64(lastContactUnix/1e9), int64(lastContactUnix%1e9))
+}
+
 // checkLeaderLease is used to check if we can contact a quorum of nodes
 // within the last leader lease interval. If not, we need to step down,
 // as we may have lost connectivity. Returns the maximum duration without
 // contact. This must only be called from the main thread.
 func (r *raftServer) checkLeaderLease() {
-	servers := len(r.memberships.latest.Servers)
-	lastContacts := make([]uint64, 0, servers)
-	if hasVote(r.memberships.latest, r.localID) {
-		lastContacts = append(lastContacts, uint64(time.Now().UnixNano()))
-	}
-	for peerID, peer := range r.peers {
-		if hasVote(r.memberships.latest, peerID) {
-			lastContacts = append(lastContacts, uint64(peer.progress.lastContact.UnixNano()))
-		}
-	}
-	lastContactUnix := quorumGeq(lastContacts)
-	lastContact := time.Unix(int64(lastContactUnix/1e9), int64(lastContactUnix%1e9))
+	lastContact := r.quorumLastContact(time.Time{})
 	diff := time.Now().Sub(lastContact)
-	metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
+	r.metrics.AddSample([]string{"raft", "leader", "lastContact"}, float32(diff/time.Millisecond))
 	if r.conf.LeaderLeaseTimeout < diff {
 		r.logger.Warn("Failed to contact quorum of nodes, stepping down")
 		r.stepDown()
-		metrics.IncrCounter([]string{"raft", "transition", "leader_lease_timeout"}, 1)
+		r.metrics.IncrCounter([]string{"raft", "transition", "leader_lease_timeout"}, 1)
+		return
 	}
+	r.updateLease()
+}
+
+// updateLease extends the read lease used by LeaseReads and publishes the
+// current read index with it. Followers that answered an RPC from us won't
+// vote for anyone else until their heartbeat timeout runs out, which is at
+// least LeaderLeaseTimeout after we sent it. No lease is held during a
+// leadership transfer, as the target is then allowed to get elected. This
+// must only be called from the main thread while leader.
+func (r *raftServer) updateLease() {
+	if !r.conf.LeaseReads || r.state != Leader {
+		return
+	}
+	if r.leaderState.leadershipTransfer != nil {
+		r.shared.setLease(time.Time{}, 0)
+		return
+	}
+	lastContact := r.quorumLastContact(r.leaderState.startTime)
+	expiry := lastContact.Add(r.conf.LeaderLeaseTimeout - r.conf.LeaseReadClockDrift)
+	r.shared.setLease(expiry, r.readIndex())
 }
 
 // appendMembershipEntry changes the configuration and adds a new membership
 // configuration entry to the log. This must only be called from the
 // main thread.
 func (r *raftServer) appendMembershipEntry(future *membershipChangeFuture) {
+	if future.req.command == EnterJoint && r.protocolVersion < 5 {
+		future.respond(ErrUnsupportedProtocol)
+		return
+	}
+	if future.req.hasMetadata() && r.protocolVersion < 6 {
+		future.respond(ErrUnsupportedProtocol)
+		return
+	}
+	future.req.localID = r.localID
 	membership, err := nextMembership(r.memberships.latest, r.memberships.latestIndex, future.req)
 	if err != nil {
 		future.respond(err)
@@ -1176,6 +1832,16 @@ func (r *raftServer) appendMembershipEntry(future *membershipChangeFuture) {
 		}
 	}
 
+	// The caller of ChangeMembership waits for the final configuration, which
+	// is appended by leaveJointMembership.
+	if future.req.command == EnterJoint {
+		r.leaderState.jointChange = future
+		joint := &membershipChangeFuture{req: future.req}
+		joint.init()
+		joint.log = future.log
+		future = joint
+	}
+
 	r.dispatchLogs([]*logFuture{&future.logFuture})
 }
 
@@ -1183,7 +1849,7 @@ func (r *raftServer) appendMembershipEntry(future *membershipChangeFuture) {
 // as inflight and begin replication of it.
 func (r *raftServer) dispatchLogs(applyLogs []*logFuture) {
 	now := time.Now()
-	defer metrics.MeasureSince([]string{"raft", "leader", "dispatchLog"}, now)
+	defer r.metrics.MeasureSince([]string{"raft", "leader", "dispatchLog"}, now)
 
 	lastIndex := r.shared.getLastIndex()
 	logs := make([]*Log, len(applyLogs))
@@ -1200,7 +1866,7 @@ func (r *raftServer) dispatchLogs(applyLogs []*logFuture) {
 
 	// Write the log entry locally
 	if err := r.logs.StoreLogs(logs); err != nil {
-		r.logger.Fatal("Failed to store log entries", "error", err)
+		logFatal(r.logger, "Failed to store log entries", "error", err)
 	}
 
 	// Update the last log since it's on disk now
@@ -1236,7 +1902,7 @@ func (r *raftServer) processLogs(index Index, future *logFuture) {
 		} else {
 			l := new(Log)
 			if err := r.logs.GetLog(idx, l); err != nil {
-				r.logger.Fatal("Failed to get log entry",
+				logFatal(r.logger, "Failed to get log entry",
 					"index", idx, "error", err)
 			}
 			r.processLog(l, nil)
@@ -1278,6 +1944,13 @@ func (r *raftServer) processLog(l *Log, future *logFuture) {
 		panic(fmt.Errorf("unrecognized log type: %#v", l))
 	}
 
+	// The FSM handler doesn't apply this entry, but it still tracks that it
+	// got this far so that ReadIndex doesn't wait on it forever
+	select {
+	case r.fsmCommitCh <- commitTuple{l, nil}:
+	case <-r.api.shutdownCh:
+	}
+
 	// Invoke the future if given
 	if future != nil {
 		future.respond(nil)
@@ -1299,6 +1972,10 @@ func (r *raftServer) processRPC(rpc RPC) {
 		r.requestVote(rpc, cmd)
 	case *InstallSnapshotRequest:
 		r.installSnapshot(rpc, cmd)
+	case *TimeoutNowRequest:
+		r.timeoutNow(rpc, cmd)
+	case *ReadIndexRequest:
+		r.readIndexRPC(rpc, cmd)
 	default:
 		r.logger.Error("Got unexpected command", "command", rpc.Command)
 		rpc.Respond(nil, fmt.Errorf("unexpected command"))
@@ -1309,7 +1986,7 @@ func (r *raftServer) processRPC(rpc RPC) {
 // so that they can be fast-pathed if a transport supports it. This must only
 // be called from the main thread.
 func (r *raftServer) processHeartbeat(rpc RPC) {
-	defer metrics.MeasureSince([]string{"raft", "rpc", "processHeartbeat"}, time.Now())
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "processHeartbeat"}, time.Now())
 
 	// Check if we are shutdown, just ignore the RPC
 	select {
@@ -1331,7 +2008,7 @@ func (r *raftServer) processHeartbeat(rpc RPC) {
 // appendEntries is invoked when we get an append entries RPC call. This must
 // only be called from the main thread.
 func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
-	defer metrics.MeasureSince([]string{"raft", "rpc", "appendEntries"}, time.Now())
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "appendEntries"}, time.Now())
 	// Setup a response
 	resp := &AppendEntriesResponse{
 		RPCHeader: r.getRPCHeader(),
@@ -1357,7 +2034,13 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	}
 	// Save the current leader
 	r.stepDown()
-	r.leader = r.trans.DecodePeer(a.Leader)
+	r.setLeader(r.trans.DecodePeer(a.Leader))
+
+	// Speak whatever version the leader negotiated
+	if r.conf.ProtocolVersion >= 3 && a.ProtocolVersion >= r.conf.ProtocolVersion &&
+		a.ProtocolVersion != r.protocolVersion {
+		r.setProtocolVersion(a.ProtocolVersion)
+	}
 	defer func() { r.lastContact = time.Now() }()
 
 	// Verify the last log entry
@@ -1368,6 +2051,11 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		if a.PrevLogEntry == lastIdx {
 			prevLogTerm = lastTerm
 
+		} else if snapIdx, snapTerm := r.shared.getLastSnapshot(); a.PrevLogEntry == snapIdx {
+			// A restored snapshot leaves no log entry at its index, but the
+			// snapshot records its term.
+			prevLogTerm = snapTerm
+
 		} else {
 			var prevLog Log
 			if err := r.logs.GetLog(a.PrevLogEntry, &prevLog); err != nil {
@@ -1378,7 +2066,7 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 						"error", err)
 					return
 				}
-				r.logger.Fatal("Failed to get previous log entry",
+				logFatal(r.logger, "Failed to get previous log entry",
 					"prev_index", a.PrevLogEntry,
 					"last_index", lastIdx,
 					"error", err)
@@ -1390,6 +2078,10 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 			r.logger.Warn("Previous log term mis-match",
 				"our_term", prevLogTerm,
 				"their_term", a.PrevLogTerm)
+			if r.protocolVersion >= 4 {
+				resp.ConflictTerm = prevLogTerm
+				resp.ConflictIndex = r.firstIndexOfTerm(prevLogTerm, a.PrevLogEntry)
+			}
 			return
 		}
 	}
@@ -1408,14 +2100,14 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 			}
 			var storeEntry Log
 			if err := r.logs.GetLog(entry.Index, &storeEntry); err != nil {
-				r.logger.Fatal("Failed to get log entry",
+				logFatal(r.logger, "Failed to get log entry",
 					"index", entry.Index, "error", err)
 			}
 			if entry.Term != storeEntry.Term {
 				r.logger.Warn("Clearing log suffix",
 					"from_index", entry.Index, "to_index", lastLogIdx)
 				if err := r.logs.DeleteRange(entry.Index, lastLogIdx); err != nil {
-					r.logger.Fatal("Failed to clear log suffix", "error", err)
+					logFatal(r.logger, "Failed to clear log suffix", "error", err)
 				}
 				if entry.Index <= r.memberships.latestIndex {
 					r.memberships.latest = r.memberships.committed
@@ -1430,7 +2122,7 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		if n := len(newEntries); n > 0 {
 			// Append the new entries
 			if err := r.logs.StoreLogs(newEntries); err != nil {
-				r.logger.Fatal("Failed to append to logs", "error", err)
+				logFatal(r.logger, "Failed to append to logs", "error", err)
 			}
 
 			// Handle any new configuration changes
@@ -1443,7 +2135,7 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 			r.shared.setLastLog(last.Index, last.Term)
 		}
 
-		metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "storeLogs"}, start)
+		r.metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "storeLogs"}, start)
 	}
 
 	// Update the commit index (see comment in AppendEntriesRequest).
@@ -1458,7 +2150,7 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 			r.memberships.committedIndex = r.memberships.latestIndex
 		}
 		r.processLogs(a.LeaderCommitIndex, nil)
-		metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "processLogs"}, start)
+		r.metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "processLogs"}, start)
 	}
 
 	// Everything went well, set success
@@ -1466,6 +2158,24 @@ func (r *raftServer) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	return
 }
 
+// firstIndexOfTerm returns the index of the first entry in our log with the
+// given term, where the entry at last is known to have that term. It's used
+// as the ConflictIndex hint for the leader, so on errors it falls back to
+// last, which is always safe.
+func (r *raftServer) firstIndexOfTerm(term Term, last Index) Index {
+	first, err := r.logs.FirstIndex()
+	if err != nil || first == 0 || first > last {
+		return last
+	}
+	idx, err := searchLogTerms(r.logs, first, last, func(t Term) bool { return t >= term })
+	if err != nil {
+		r.logger.Warn("Failed to find first log entry of term",
+			"term", term, "error", err)
+		return last
+	}
+	return idx
+}
+
 // processMembershipLogEntry takes a log entry and updates the latest
 // membership if the entry results in a new membership. This must only be
 // called from the main thread, or from NewRaft() before any threads have begun.
@@ -1486,7 +2196,7 @@ func (r *raftServer) processMembershipLogEntry(entry *Log) {
 
 // requestVote is invoked when we get an request vote RPC call.
 func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
-	defer metrics.MeasureSince([]string{"raft", "rpc", "requestVote"}, time.Now())
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "requestVote"}, time.Now())
 	r.observe(*req)
 
 	// Setup a response
@@ -1494,6 +2204,7 @@ func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
 		RPCHeader: r.getRPCHeader(),
 		Term:      r.currentTerm,
 		Granted:   false,
+		PreVote:   req.PreVote,
 	}
 	var rpcErr error
 	defer func() {
@@ -1506,9 +2217,10 @@ func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
 		resp.Peers = encodePeers(r.memberships.latest, r.trans)
 	}
 
-	// Check if we have an existing leader [who's not the candidate]
+	// Check if we have an existing leader [who's not the candidate], unless
+	// that leader is the one handing off leadership to the candidate
 	candidate := r.trans.DecodePeer(req.Candidate)
-	if r.leader != "" && r.leader != candidate {
+	if r.leader != "" && r.leader != candidate && !req.LeadershipTransfer {
 		r.logger.Warn("Rejecting vote request since we have a leader",
 			"candidate", candidate, "leader", r.leader)
 		return
@@ -1519,8 +2231,8 @@ func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
 		return
 	}
 
-	// Increase the term if we see a newer one
-	if req.Term > r.currentTerm {
+	// Increase the term if we see a newer one, unless this is only a pre-vote
+	if req.Term > r.currentTerm && !req.PreVote {
 		r.updateTerm(req.Term)
 		resp.Term = req.Term
 	}
@@ -1570,6 +2282,12 @@ func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
 		return
 	}
 
+	// A pre-vote only asks whether we would vote, so there's nothing to persist
+	if req.PreVote {
+		resp.Granted = true
+		return
+	}
+
 	// Persist a vote for safety
 	if err := r.persistVote(req.Term, req.Candidate); err != nil {
 		r.logger.Error("Failed to persist vote", "error", err)
@@ -1586,7 +2304,7 @@ func (r *raftServer) requestVote(rpc RPC, req *RequestVoteRequest) {
 // too far behind a leader for log replay. This must only be called
 // from the main thread.
 func (r *raftServer) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
-	defer metrics.MeasureSince([]string{"raft", "rpc", "installSnapshot"}, time.Now())
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "installSnapshot"}, time.Now())
 	// Setup a response
 	resp := &InstallSnapshotResponse{
 		Term:    r.currentTerm,
@@ -1616,7 +2334,7 @@ func (r *raftServer) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	}
 	// Save the current leader
 	r.stepDown()
-	r.leader = r.trans.DecodePeer(req.Leader)
+	r.setLeader(r.trans.DecodePeer(req.Leader))
 	defer func() { r.lastContact = time.Now() }()
 
 	// Create a new snapshot
@@ -1704,8 +2422,102 @@ func (r *raftServer) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	return
 }
 
-// persistVote is used to persist our vote for safety.
+// timeoutNow is invoked when we get a TimeoutNow RPC call, which the leader
+// sends to hand off leadership to us. We start an election right away rather
+// than waiting for the heartbeat timeout. This must only be called from the
+// main thread.
+func (r *raftServer) timeoutNow(rpc RPC, req *TimeoutNowRequest) {
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "timeoutNow"}, time.Now())
+	// Setup a response
+	resp := &TimeoutNowResponse{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.currentTerm,
+	}
+	var rpcErr error
+	defer func() {
+		rpc.Respond(resp, rpcErr)
+	}()
+
+	// Ignore an older term
+	if req.Term < r.currentTerm {
+		return
+	}
+
+	// Increase the term if we see a newer one
+	if req.Term > r.currentTerm {
+		r.updateTerm(req.Term)
+		resp.Term = req.Term
+	}
+
+	if r.state != Follower {
+		rpcErr = fmt.Errorf("cannot start election while %v", r.state)
+		return
+	}
+	if !hasVote(r.memberships.latest, r.localID) {
+		rpcErr = fmt.Errorf("cannot start election without a vote")
+		return
+	}
+
+	r.logger.Info("Received TimeoutNow, starting election",
+		"leader", r.trans.DecodePeer(req.Leader), "term", r.currentTerm)
+	r.metrics.IncrCounter([]string{"raft", "transition", "leadership_transfer"}, 1)
+	r.setState(Candidate)
+	r.candidateFromLeadershipTransfer = true
+	r.updatePeers()
+}
+
+// readIndexRPC is invoked when a follower asks us for a read index. As with
+// Raft.ReadIndex, we answer from our lease or confirm leadership with a round
+// of heartbeats first. The response is sent once that completes, without
+// blocking the main thread. This must only be called from the main thread.
+func (r *raftServer) readIndexRPC(rpc RPC, req *ReadIndexRequest) {
+	defer r.metrics.MeasureSince([]string{"raft", "rpc", "readIndex"}, time.Now())
+	if r.state != Leader {
+		rpc.Respond(nil, ErrNotLeader)
+		return
+	}
+	resp := &ReadIndexResponse{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.currentTerm,
+	}
+
+	if r.conf.LeaseReads {
+		if index, ok := r.shared.getLease(); ok {
+			r.metrics.IncrCounter([]string{"raft", "read_index", "lease"}, 1)
+			resp.Index = index
+			rpc.Respond(resp, nil)
+			return
+		}
+		r.metrics.IncrCounter([]string{"raft", "read_index", "fallback"}, 1)
+	}
+
+	future := &verifyFuture{index: r.readIndex()}
+	future.shutdownCh = r.api.shutdownCh
+	future.init()
+	r.verifyLeader([]*verifyFuture{future})
+	r.goRoutines.spawn(func() {
+		if err := future.Error(); err != nil {
+			rpc.Respond(nil, err)
+			return
+		}
+		resp.Index = future.index
+		rpc.Respond(resp, nil)
+	})
+}
+
+// persistVote is used to persist our vote for safety. The current term is
+// saved first, in the same batch if the StableStore supports it.
 func (r *raftServer) persistVote(term Term, candidate []byte) error {
+	if batch, ok := r.stable.(StableStoreBatch); ok {
+		return batch.SetBatch([]StableWrite{
+			{Key: keyCurrentTerm, IsUint64: true, Uint64: uint64(r.currentTerm)},
+			{Key: keyLastVoteTerm, IsUint64: true, Uint64: uint64(term)},
+			{Key: keyLastVoteCand, Val: candidate},
+		})
+	}
+	if err := r.stable.SetUint64(keyCurrentTerm, uint64(r.currentTerm)); err != nil {
+		return err
+	}
 	if err := r.stable.SetUint64(keyLastVoteTerm, uint64(term)); err != nil {
 		return err
 	}
@@ -1747,7 +2559,7 @@ func (r *raftServer) persistCurrentTerm() {
 // that leader should be set only after updating the state.
 // The caller must call updatePeers() after changing the state.
 func (r *raftServer) setState(state RaftState) {
-	r.leader = ""
+	r.setLeader("")
 	oldState := r.state
 	r.state = state
 	if oldState != state {
@@ -1755,6 +2567,31 @@ func (r *raftServer) setState(state RaftState) {
 	}
 }
 
+// setLeader is used to update the known leader of the cluster. The leader's
+// ServerID is looked up by address in the latest membership configuration,
+// and is left empty if the address isn't found there. This must only be
+// called from the main thread.
+func (r *raftServer) setLeader(addr ServerAddress) {
+	var id ServerID
+	if addr == r.localAddr {
+		id = r.localID
+	} else if addr != "" {
+		for _, server := range r.memberships.latest.allServers() {
+			if server.Address == addr {
+				id = server.ID
+				break
+			}
+		}
+	}
+	if addr == r.leader && id == r.leaderID {
+		return
+	}
+	r.leader = addr
+	r.leaderID = id
+	r.shared.setLeader(addr, id)
+	r.observe(LeaderObservation{LeaderAddr: addr, LeaderID: id})
+}
+
 // Fills in stats when requested by application.
 // Must only be called from the main Raft goroutine.
 func (r *raftServer) stats() *Stats {
@@ -1802,5 +2639,33 @@ func (r *raftServer) stats() *Stats {
 	}
 	s.NumPeers = numPeers
 
+	if r.state == Leader {
+		for _, server := range membership.allServers() {
+			if server.ID == r.localID {
+				continue
+			}
+			peer, ok := r.peers[server.ID]
+			if !ok {
+				continue
+			}
+			ps := PeerStats{
+				ID:                 server.ID,
+				Address:            server.Address,
+				Suffrage:           server.Suffrage,
+				MatchIndex:         peer.progress.matchIndex,
+				NextIndex:          peer.progress.nextIndex,
+				LastContact:        peer.progress.lastContact,
+				InstallingSnapshot: peer.progress.installingSnapshot,
+			}
+			if lastLogIndex > ps.MatchIndex {
+				ps.Lag = uint64(lastLogIndex - ps.MatchIndex)
+			}
+			s.Peers = append(s.Peers, ps)
+		}
+		sort.Slice(s.Peers, func(i, j int) bool {
+			return s.Peers[i].ID < s.Peers[j].ID
+		})
+	}
+
 	return s
 }
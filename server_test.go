@@ -2,6 +2,7 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,7 +16,6 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-msgpack/codec"
-	log "github.com/mgutz/logxi/v1"
 )
 
 // MockFSM is an implementation of the FSM interface, and just stores
@@ -80,11 +80,11 @@ func inmemConfig(t *testing.T) *Config {
 	return conf
 }
 
-func newTestLogger(t *testing.T) log.Logger {
+func newTestLogger(t *testing.T) Logger {
 	return newTestLoggerWithPrefix(t, "")
 }
 
-func newTestLoggerWithPrefix(t *testing.T, prefix string) log.Logger {
+func newTestLoggerWithPrefix(t *testing.T, prefix string) Logger {
 	return NewRaftLoggerForTesting(os.Stderr, prefix)
 }
 
@@ -96,11 +96,11 @@ type cluster struct {
 	trans            []LoopbackTransport
 	rafts            []*Raft
 	t                *testing.T
-	observationCh    chan interface{}
+	observationCh    chan Observation
 	conf             *Config
 	propagateTimeout time.Duration
 	longstopTimeout  time.Duration
-	logger           log.Logger
+	logger           Logger
 	startTime        time.Time
 
 	failedLock sync.Mutex
@@ -574,7 +574,7 @@ func makeCluster(n int, bootstrap bool, t *testing.T, conf *Config) *cluster {
 	}
 
 	c := &cluster{
-		observationCh: make(chan interface{}, 1024),
+		observationCh: make(chan Observation, 1024),
 		conf:          conf,
 		// Propagation takes a maximum of 2 heartbeat timeouts (time to
 		// get a new heartbeat that would cause a commit) plus a bit.
@@ -642,7 +642,7 @@ func makeCluster(n int, bootstrap bool, t *testing.T, conf *Config) *cluster {
 			c.FailNowf("NewRaft failed: %v", err)
 		}
 
-		raft.serverInternals.registerObserver(c.observationCh)
+		raft.RegisterObserver(NewObserver(c.observationCh, false, nil))
 		if err != nil {
 			c.FailNowf("RegisterObserver failed: %v", err)
 		}
@@ -804,6 +804,36 @@ func TestRaft_TripleNode(t *testing.T) {
 	c.WaitForReplication(1)
 }
 
+func TestRaft_PersistVote(t *testing.T) {
+	// InmemStore saves the term and vote as one batch
+	var _ StableStoreBatch = NewInmemStore()
+
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	term := c.getTerm(leader)
+
+	for i, r := range c.rafts {
+		store := c.stores[i]
+		currentTerm, _ := store.GetUint64(keyCurrentTerm)
+		lastVoteTerm, _ := store.GetUint64(keyLastVoteTerm)
+		if lastVoteTerm > currentTerm {
+			c.FailNowf("server %d voted in term %d beyond its term %d", i, lastVoteTerm, currentTerm)
+		}
+		if r != leader {
+			continue
+		}
+		if Term(currentTerm) != term || Term(lastVoteTerm) != term {
+			c.FailNowf("expected leader term and vote term %d, got %d and %d",
+				term, currentTerm, lastVoteTerm)
+		}
+		cand, _ := store.Get(keyLastVoteCand)
+		if !bytes.Equal(cand, c.trans[i].EncodePeer(leader.serverInternals.localAddr)) {
+			c.FailNowf("expected leader to vote for itself, got %q", cand)
+		}
+	}
+}
+
 func TestRaft_LeaderFail(t *testing.T) {
 	// Make the cluster
 	c := MakeCluster(3, t, nil)
@@ -1070,6 +1100,264 @@ func TestRaft_JoinNode(t *testing.T) {
 	c.EnsureSamePeers(t)
 }
 
+func TestRaft_AddVoterWithMetadata(t *testing.T) {
+	// Make a cluster
+	conf := inmemConfig(t)
+	conf.TrailingLogs = 0
+	c := MakeCluster(2, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Label an existing voter
+	id := leader.serverInternals.localID
+	addr := leader.serverInternals.localAddr
+	future := leader.AddVoterWithMetadata(id, addr, map[string]string{"zone": "zone1"}, 0, 0)
+	if err := future.Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// Snapshot so the new node gets the membership from there
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	if err := leader.Snapshot().Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// Join a new node with its own label
+	c1 := MakeClusterNoBootstrap(1, t, conf)
+	c.Merge(c1)
+	c.FullyConnect()
+	r := c1.rafts[0].serverInternals
+	future = leader.AddNonvoterWithMetadata(r.localID, r.localAddr, map[string]string{"zone": "zone2"}, 0, 0)
+	if err := future.Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	c.EnsureSame(t)
+	c.EnsureSamePeers(t)
+
+	zones := make(map[ServerID]string)
+	for _, server := range c.getMembership(c1.rafts[0]).Servers {
+		zones[server.ID] = server.Metadata["zone"]
+	}
+	if zones[id] != "zone1" || zones[r.localID] != "zone2" {
+		c.FailNowf("bad zones: %v", zones)
+	}
+
+	// The installed snapshot carried the first label
+	snaps, err := c1.snaps[0].List()
+	if err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	if len(snaps) == 0 {
+		c.FailNowf("expected a snapshot")
+	}
+	for _, server := range snaps[0].Membership.Servers {
+		if server.ID == id && server.Metadata["zone"] != "zone1" {
+			c.FailNowf("bad snapshot membership: %v", snaps[0].Membership)
+		}
+	}
+}
+
+func TestRaft_AddVoterWithMetadataContext(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	id := leader.serverInternals.localID
+	addr := leader.serverInternals.localAddr
+	zone := func() string {
+		for _, server := range c.getMembership(leader).Servers {
+			if server.ID == id {
+				return server.Metadata["zone"]
+			}
+		}
+		return ""
+	}
+
+	// A change whose context is already done is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := leader.AddVoterWithMetadataContext(ctx, id, addr, map[string]string{"zone": "zone1"}, 0).Error()
+	if err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+	err = leader.AddNonvoterWithMetadataContext(ctx, "s2", "s2", map[string]string{"zone": "zone2"}, 0).Error()
+	if err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+	if z := zone(); z != "" {
+		c.FailNowf("cancelled change was applied: zone %q", z)
+	}
+
+	err = leader.AddVoterWithMetadataContext(context.Background(), id, addr, map[string]string{"zone": "zone1"}, 0).Error()
+	if err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	if z := zone(); z != "zone1" {
+		c.FailNowf("expected zone1, got %q", z)
+	}
+}
+
+func TestRaft_AddVoterWithMetadata_OldProtocol(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.ProtocolVersion = 2
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	id := leader.serverInternals.localID
+	addr := leader.serverInternals.localAddr
+	err := leader.AddVoterWithMetadata(id, addr, map[string]string{"zone": "zone1"}, 0, 0).Error()
+	if err != ErrUnsupportedProtocol {
+		c.FailNowf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
+
+func TestRaft_ChangeMembership(t *testing.T) {
+	// Make a cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	oldLeader := c.Leader()
+
+	// Make a second cluster of 3 to replace the first
+	c1 := MakeClusterNoBootstrap(3, t, nil)
+
+	// Merge clusters
+	c.Merge(c1)
+	c.FullyConnect()
+
+	// Swap every server out in one change
+	var target Membership
+	for _, r := range c1.rafts {
+		target.Servers = append(target.Servers, Server{
+			Suffrage: Voter,
+			ID:       r.serverInternals.localID,
+			Address:  r.serverInternals.localAddr,
+		})
+	}
+	future := oldLeader.ChangeMembership(target, 0, 0)
+	if err := future.Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// The old followers may not learn they were removed; shut them down so they
+	// don't keep calling elections.
+	for _, r := range c.rafts[:3] {
+		if err := r.Shutdown().Error(); err != nil {
+			c.FailNowf("err: %v", err)
+		}
+	}
+
+	// A leader emerges from the new servers
+	leader := c1.Leader()
+	if err := leader.Apply([]byte("test"), commitTimeout).Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// The new servers agree on the final membership
+	for _, r := range c1.rafts {
+		membership := c.getMembership(r)
+		if membership.joint() || !reflect.DeepEqual(membership.Servers, target.Servers) {
+			c.FailNowf("%v has membership %v", r.serverInternals.localID, membership)
+		}
+	}
+
+	// A joint target is rejected
+	target.OldServers = target.Servers
+	if err := leader.ChangeMembership(target, 0, 0).Error(); err == nil {
+		c.FailNowf("ChangeMembership should have rejected a joint membership")
+	}
+}
+
+func TestRaft_ChangeMembership_OldProtocol(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.ProtocolVersion = 2
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	var target Membership
+	for _, r := range c.rafts[:2] {
+		target.Servers = append(target.Servers, Server{
+			Suffrage: Voter,
+			ID:       r.serverInternals.localID,
+			Address:  r.serverInternals.localAddr,
+		})
+	}
+	err := c.Leader().ChangeMembership(target, 0, 0).Error()
+	if err != ErrUnsupportedProtocol {
+		c.FailNowf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
+
+func TestRaft_UpdateServerAddress(t *testing.T) {
+	// Use pre-vote so the follower doesn't disrupt the leader while it's
+	// unreachable.
+	conf := inmemConfig(t)
+	conf.PreVote = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+	followerID := follower.serverInternals.localID
+	followerAddr := follower.serverInternals.localAddr
+
+	observations := make(chan Observation, 100)
+	observer := NewObserver(observations, false, func(o *Observation) bool {
+		_, ok := o.Data.(PeerObservation)
+		return ok
+	})
+	leader.RegisterObserver(observer)
+	defer leader.DeregisterObserver(observer)
+	expectPeer := func(address ServerAddress) {
+		deadline := time.After(c.longstopTimeout)
+		for {
+			select {
+			case o := <-observations:
+				peer := o.Data.(PeerObservation)
+				if !peer.Removed && peer.Peer.ID == followerID && peer.Peer.Address == address {
+					return
+				}
+			case <-deadline:
+				c.FailNowf("timed out waiting for peer at %v", address)
+			}
+		}
+	}
+
+	// Move the follower somewhere unreachable
+	if err := leader.UpdateServerAddress(followerID, "bogus", 0, 0).Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	expectPeer("bogus")
+	membership := c.getMembership(leader)
+	for _, server := range membership.Servers {
+		if server.ID == followerID && (server.Address != "bogus" || server.Suffrage != Voter) {
+			c.FailNowf("bad membership: %v", membership)
+		}
+	}
+
+	// Unknown servers and duplicate addresses are rejected
+	if err := leader.UpdateServerAddress("unknown", "addr", 0, 0).Error(); err == nil {
+		c.FailNowf("UpdateServerAddress should have failed for an unknown server")
+	}
+	if err := leader.UpdateServerAddress(followerID, leader.serverInternals.localAddr, 0, 0).Error(); err == nil {
+		c.FailNowf("UpdateServerAddress should have failed for a duplicate address")
+	}
+	if err := leader.UpdateServerAddress(leader.serverInternals.localID, "elsewhere", 0, 0).Error(); err == nil {
+		c.FailNowf("UpdateServerAddress should have failed for the leader itself")
+	}
+
+	// Move it back, and it catches up
+	if err := leader.UpdateServerAddress(followerID, followerAddr, 0, 0).Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	expectPeer(followerAddr)
+	if err := leader.Apply([]byte("test"), commitTimeout).Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	c.EnsureSame(t)
+	c.EnsureSamePeers(t)
+}
+
 func TestRaft_RemoveFollower(t *testing.T) {
 	// Make a cluster
 	c := MakeCluster(3, t, nil)
@@ -1806,6 +2094,49 @@ func TestRaft_LeaderLeaseExpire(t *testing.T) {
 	}
 }
 
+func TestRaft_LeaderLeaseExpire_NeverContacted(t *testing.T) {
+	// Start a leader whose only peer never answers
+	conf := inmemConfig(t)
+	conf.StartAsLeader = true
+	conf.LocalID = "s1"
+	store := NewInmemStore()
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+	addr, trans := NewInmemTransport("")
+	membership := Membership{
+		Servers: []Server{
+			{Suffrage: Voter, ID: "s1", Address: addr},
+			{Suffrage: Voter, ID: "s2", Address: "unreachable"},
+		},
+	}
+	if err := BootstrapCluster(conf, store, store, snap, trans, membership); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	start := time.Now()
+	leader, err := NewRaft(conf, &MockFSM{}, store, store, snap, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer leader.Shutdown()
+
+	// It gets a lease's worth of time, then steps down
+	timeout := time.After(conf.LeaderLeaseTimeout * 4)
+	for {
+		select {
+		case v := <-leader.LeaderCh():
+			if v {
+				continue
+			}
+			if elapsed := time.Since(start); elapsed < conf.LeaderLeaseTimeout {
+				t.Fatalf("stepped down after %v, before the lease ran out", elapsed)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timeout stepping down as leader")
+		}
+	}
+}
+
 func TestRaft_Barrier(t *testing.T) {
 	// Make the cluster
 	c := MakeCluster(3, t, nil)
@@ -1934,97 +2265,750 @@ func TestRaft_VerifyLeader_ParitalConnect(t *testing.T) {
 	}
 }
 
-func TestRaft_StartAsLeader(t *testing.T) {
-	conf := inmemConfig(t)
-	conf.StartAsLeader = true
-	c := MakeCluster(1, t, conf)
+func TestRaft_ReadIndex(t *testing.T) {
+	c := MakeCluster(3, t, nil)
 	defer c.Close()
-	raft := c.rafts[0]
 
-	// Watch leaderCh for change
-	select {
-	case v := <-raft.LeaderCh():
-		if !v {
-			c.FailNowf("should become leader")
+	leader := c.Leader()
+	var last Index
+	for i := 0; i < 10; i++ {
+		future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
 		}
-	case <-time.After(c.conf.HeartbeatTimeout * 4):
-		// Longer than you think as possibility of multiple elections
-		c.FailNowf("timeout becoming leader")
+		last = future.Index()
 	}
 
-	// Should be leader
-	if s := c.getState(raft); s != Leader {
-		c.FailNowf("expected leader: %v", s)
+	index, err := leader.ReadIndex(context.Background())
+	if err != nil {
+		c.FailNowf("read index err: %v", err)
+	}
+	if index < last {
+		c.FailNowf("read index %v is behind last write %v", index, last)
 	}
 
-	// Should be able to apply
-	future := raft.Apply([]byte("test"), commitTimeout)
-	if err := future.Error(); err != nil {
-		c.FailNowf("err: %v", err)
+	// Every write that completed before the read must be visible.
+	fsm := c.fsms[c.IndexOf(leader)]
+	fsm.Lock()
+	num := len(fsm.logs)
+	fsm.Unlock()
+	if num != 10 {
+		c.FailNowf("expected 10 entries applied, got %d", num)
 	}
 
-	// Check the response
-	if future.Response().(int) != 1 {
-		c.FailNowf("bad response: %v", future.Response())
+	// Followers can't serve reads this way.
+	if _, err := c.Followers()[0].ReadIndex(context.Background()); err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
 	}
+}
 
-	// Check the index
-	if idx := future.Index(); idx == 0 {
-		c.FailNowf("bad index: %d", idx)
+func TestRaft_ReadIndex_Single(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	if _, err := leader.ReadIndex(context.Background()); err != nil {
+		c.FailNowf("read index err: %v", err)
 	}
+}
 
-	// Check that it is applied to the FSM
-	if len(c.fsms[0].logs) != 1 {
-		c.FailNowf("did not apply to FSM!")
+func TestRaft_ReadIndex_Partitioned(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Cut the leader off from both followers; it can no longer confirm that
+	// it's the leader, so the read must not succeed.
+	leader := c.Leader()
+	c.Disconnect(leader.serverInternals.localAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.longstopTimeout)
+	defer cancel()
+	if _, err := leader.ReadIndex(ctx); err == nil {
+		c.FailNowf("expected read index to fail on a partitioned leader")
 	}
 }
 
-func TestRaft_NotifyCh(t *testing.T) {
-	ch := make(chan bool, 1)
+func TestRaft_ReadIndex_Lease(t *testing.T) {
 	conf := inmemConfig(t)
-	conf.NotifyCh = ch
-	c := MakeCluster(1, t, conf)
+	conf.HeartbeatTimeout = 500 * time.Millisecond
+	conf.ElectionTimeout = 500 * time.Millisecond
+	conf.LeaderLeaseTimeout = 500 * time.Millisecond
+	conf.LeaseReads = true
+	c := MakeCluster(3, t, conf)
 	defer c.Close()
 
-	// Watch leaderCh for change
-	select {
-	case v := <-ch:
-		if !v {
-			c.FailNowf("should become leader")
+	// Every read must reflect the write that completed just before it.
+	leader := c.Leader()
+	var future ApplyFuture
+	for i := 0; i < 200; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+		index, err := leader.ReadIndex(context.Background())
+		if err != nil {
+			c.FailNowf("read index err: %v", err)
+		}
+		if index < future.Index() {
+			c.FailNowf("read index %v is behind last write %v", index, future.Index())
 		}
-	case <-time.After(conf.HeartbeatTimeout * 8):
-		c.FailNowf("timeout becoming leader")
 	}
 
-	// Close the cluster
-	c.Close()
+	// Cut the leader off. While its lease lasts it can still serve reads
+	// without hearing from the followers.
+	c.Disconnect(leader.serverInternals.localAddr)
+	index, err := leader.ReadIndex(context.Background())
+	if err != nil {
+		c.FailNowf("lease read err: %v", err)
+	}
+	if index < future.Index() {
+		c.FailNowf("read index %v is behind last write %v", index, future.Index())
+	}
 
-	// Watch leaderCh for change
-	select {
-	case v := <-ch:
-		if v {
-			c.FailNowf("should step down as leader")
-		}
-	case <-time.After(conf.HeartbeatTimeout * 6):
-		c.FailNowf("timeout on step down as leader")
+	// Once the lease runs out, it falls back to a heartbeat round, which
+	// can't succeed.
+	time.Sleep(conf.LeaderLeaseTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), c.longstopTimeout)
+	defer cancel()
+	if _, err := leader.ReadIndex(ctx); err == nil {
+		c.FailNowf("expected read index to fail after the lease expired")
 	}
 }
 
-func TestRaft_Voting(t *testing.T) {
-	c := MakeCluster(3, t, nil)
+func TestRaft_ReadIndex_LeaseTransfer(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LeaseReads = true
+	conf.LeaseReadClockDrift = 5 * time.Millisecond
+	c := MakeCluster(3, t, conf)
 	defer c.Close()
-	followers := c.Followers()
-	ldr := c.Leader()
-	ldrT := c.trans[c.IndexOf(ldr)]
 
-	reqVote := RequestVoteRequest{
-		RPCHeader:    ldr.serverInternals.getRPCHeader(),
-		Term:         c.getTerm(ldr) + 10,
-		Candidate:    ldrT.EncodePeer(ldr.serverInternals.localAddr),
-		LastLogIndex: c.getLastIndex(ldr),
-		LastLogTerm:  c.getTerm(ldr),
+	// The old leader gives up its lease when handing off leadership, so it
+	// can't serve stale reads after the new leader takes writes.
+	oldLeader := c.Leader()
+	if err := oldLeader.LeadershipTransfer().Error(); err != nil {
+		c.FailNowf("leadership transfer err: %v", err)
 	}
-	// a follower that thinks there's a leader should vote for that leader.
+	if _, ok := oldLeader.shared.getLease(); ok {
+		c.FailNowf("expected no lease after leadership transfer")
+	}
+	if _, err := oldLeader.ReadIndex(context.Background()); err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestRaft_FollowerReadIndex(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last Index
+	for i := 0; i < 10; i++ {
+		future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+		last = future.Index()
+	}
+
+	// Every server can serve the read, and must have applied every write
+	// that completed before it.
+	for i, r := range c.rafts {
+		index, err := r.FollowerReadIndex(context.Background())
+		if err != nil {
+			c.FailNowf("follower read index err on server %d: %v", i, err)
+		}
+		if index < last {
+			c.FailNowf("read index %v is behind last write %v", index, last)
+		}
+		fsm := c.fsms[i]
+		fsm.Lock()
+		num := len(fsm.logs)
+		fsm.Unlock()
+		if num != 10 {
+			c.FailNowf("expected 10 entries applied on server %d, got %d", i, num)
+		}
+	}
+}
+
+func TestRaft_FollowerReadIndex_Lease(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.LeaseReads = true
+	conf.LeaseReadClockDrift = 5 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	future := c.Leader().Apply([]byte("test"), 0)
+	if err := future.Error(); err != nil {
+		c.FailNowf("apply err: %v", err)
+	}
+	index, err := c.Followers()[0].FollowerReadIndex(context.Background())
+	if err != nil {
+		c.FailNowf("follower read index err: %v", err)
+	}
+	if index < future.Index() {
+		c.FailNowf("read index %v is behind last write %v", index, future.Index())
+	}
+}
+
+func TestRaft_FollowerReadIndex_Shutdown(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+	follower := c.rafts[0]
+	followerAddr := follower.serverInternals.localAddr
+
+	// Point the follower at a leader that never answers.
+	ghostAddr, ghostTrans := NewInmemTransport("")
+	defer ghostTrans.Close()
+	ghostTrans.Connect(followerAddr, c.trans[0])
+	c.trans[0].Connect(ghostAddr, ghostTrans)
+	req := AppendEntriesRequest{
+		RPCHeader: makeRPCHeader(ProtocolVersionMax),
+		Term:      1,
+		Leader:    ghostTrans.EncodePeer(ghostAddr),
+	}
+	var resp AppendEntriesResponse
+	if err := ghostTrans.AppendEntries(followerAddr, &req, &resp); err != nil || !resp.Success {
+		c.FailNowf("append entries err: %v %+v", err, resp)
+	}
+
+	// The caller gives up right away, but Shutdown waits for the request to
+	// the leader to time out.
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := follower.FollowerReadIndex(ctx); err != context.DeadlineExceeded {
+		c.FailNowf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := follower.Shutdown().Error(); err != nil {
+		c.FailNowf("shutdown err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < ghostTrans.timeout {
+		c.FailNowf("shutdown returned after %v, before the request timed out", elapsed)
+	}
+}
+
+func TestRaft_FollowerReadIndex_NoLeader(t *testing.T) {
+	c := MakeClusterNoBootstrap(1, t, nil)
+	defer c.Close()
+
+	if _, err := c.rafts[0].FollowerReadIndex(context.Background()); err != ErrNoLeader {
+		c.FailNowf("expected ErrNoLeader, got %v", err)
+	}
+}
+
+func TestRaft_SnapshotOpen(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	var last Index
+	for i := 0; i < 10; i++ {
+		future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+		last = future.Index()
+	}
+
+	snapFuture := leader.Snapshot()
+	if err := snapFuture.Error(); err != nil {
+		c.FailNowf("snapshot err: %v", err)
+	}
+	meta, source, err := snapFuture.Open()
+	if err != nil {
+		c.FailNowf("open err: %v", err)
+	}
+	defer source.Close()
+	if meta.Index != last {
+		c.FailNowf("expected snapshot at index %d, got %d", last, meta.Index)
+	}
+
+	// The snapshot should hold what the FSM had applied.
+	var fsm MockFSM
+	if err := fsm.Restore(source); err != nil {
+		c.FailNowf("restore err: %v", err)
+	}
+	if len(fsm.logs) != 10 {
+		c.FailNowf("expected 10 entries in snapshot, got %d", len(fsm.logs))
+	}
+
+	// Open may only be called once.
+	if _, _, err := snapFuture.Open(); err == nil {
+		c.FailNowf("expected second open to fail")
+	}
+}
+
+func TestRaft_SnapshotOpen_Reaped(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	// Take a snapshot, then enough newer ones that it gets reaped.
+	leader := c.Leader()
+	var futures []SnapshotFuture
+	var indexes []Index
+	for i := 0; i < 4; i++ {
+		future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+		snapFuture := leader.Snapshot()
+		if err := snapFuture.Error(); err != nil {
+			c.FailNowf("snapshot err: %v", err)
+		}
+		futures = append(futures, snapFuture)
+		indexes = append(indexes, future.Index())
+	}
+	snaps, err := c.snaps[0].List()
+	if err != nil {
+		c.FailNowf("list err: %v", err)
+	}
+	for _, snap := range snaps {
+		if snap.Index == indexes[0] {
+			c.FailNowf("expected the first snapshot to be reaped")
+		}
+	}
+
+	// It can still be opened from its future.
+	meta, source, err := futures[0].Open()
+	if err != nil {
+		c.FailNowf("open err: %v", err)
+	}
+	defer source.Close()
+	if meta.Index != indexes[0] {
+		c.FailNowf("expected snapshot at index %d, got %d", indexes[0], meta.Index)
+	}
+	var fsm MockFSM
+	if err := fsm.Restore(source); err != nil {
+		c.FailNowf("restore err: %v", err)
+	}
+	if len(fsm.logs) != 1 {
+		c.FailNowf("expected 1 entry in snapshot, got %d", len(fsm.logs))
+	}
+	for _, future := range futures[1:] {
+		if err := future.Close(); err != nil {
+			c.FailNowf("close err: %v", err)
+		}
+	}
+}
+
+func TestRaft_SnapshotClose(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		c.FailNowf("apply err: %v", err)
+	}
+
+	// Closing an unopened snapshot releases it, and it can't be opened after.
+	snapFuture := leader.Snapshot()
+	if err := snapFuture.Error(); err != nil {
+		c.FailNowf("snapshot err: %v", err)
+	}
+	if err := snapFuture.Close(); err != nil {
+		c.FailNowf("close err: %v", err)
+	}
+	if _, _, err := snapFuture.Open(); err == nil {
+		c.FailNowf("expected open to fail after close")
+	}
+	if err := snapFuture.Close(); err != nil {
+		c.FailNowf("second close err: %v", err)
+	}
+
+	// Concurrent Opens hand the snapshot over exactly once.
+	snapFuture = leader.Snapshot()
+	if err := snapFuture.Error(); err != nil {
+		c.FailNowf("snapshot err: %v", err)
+	}
+	var wg sync.WaitGroup
+	var opened int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, source, err := snapFuture.Open(); err == nil {
+				atomic.AddInt32(&opened, 1)
+				source.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if opened != 1 {
+		c.FailNowf("expected one successful open, got %d", opened)
+	}
+	if err := snapFuture.Close(); err != nil {
+		c.FailNowf("close after open err: %v", err)
+	}
+}
+
+func TestRaft_UserRestore(t *testing.T) {
+	// The snapshot's own index may fall at the start of the log, within it or
+	// past its end.
+	offsets := []int64{-100, -1, 0, 1, 100}
+	for _, offset := range offsets {
+		c := MakeCluster(3, t, nil)
+
+		// Apply some logs and take a snapshot to restore from later.
+		leader := c.Leader()
+		for i := 0; i < 10; i++ {
+			future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+			if err := future.Error(); err != nil {
+				c.FailNowf("apply err: %v", err)
+			}
+		}
+		snapFuture := leader.Snapshot()
+		if err := snapFuture.Error(); err != nil {
+			c.FailNowf("snapshot err: %v", err)
+		}
+		meta, source, err := snapFuture.Open()
+		if err != nil {
+			c.FailNowf("open err: %v", err)
+		}
+		data, err := ioutil.ReadAll(source)
+		source.Close()
+		if err != nil {
+			c.FailNowf("read err: %v", err)
+		}
+
+		// Apply some more logs, which the restore will roll back.
+		for i := 10; i < 20; i++ {
+			future := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+			if err := future.Error(); err != nil {
+				c.FailNowf("apply err: %v", err)
+			}
+		}
+
+		// The snapshot's own index shouldn't matter; the restore always lands
+		// past the end of the log.
+		lastIndex := c.getLastIndex(leader)
+		if index := int64(meta.Index) + offset; index > 0 {
+			meta.Index = Index(index)
+		} else {
+			meta.Index = 0
+		}
+		if err := leader.Restore(meta, bytes.NewReader(data), 0); err != nil {
+			c.FailNowf("restore err (offset %d): %v", offset, err)
+		}
+		if idx := c.getLastIndex(leader); idx <= lastIndex || idx <= meta.Index {
+			c.FailNowf("restore should be past index %d and %d, got %d", lastIndex, meta.Index, idx)
+		}
+
+		// Every FSM should be back to the first 10 entries, and keep working
+		// from there.
+		c.WaitForReplication(10)
+		future := leader.Apply([]byte("after"), 0)
+		if err := future.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+		c.WaitForReplication(11)
+		c.EnsureSame(t)
+		c.Close()
+	}
+}
+
+func TestRaft_UserRestore_CaughtUp(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		if err := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+	}
+	snapFuture := leader.Snapshot()
+	if err := snapFuture.Error(); err != nil {
+		c.FailNowf("snapshot err: %v", err)
+	}
+	meta, source, err := snapFuture.Open()
+	if err != nil {
+		c.FailNowf("open err: %v", err)
+	}
+	data, err := ioutil.ReadAll(source)
+	source.Close()
+	if err != nil {
+		c.FailNowf("read err: %v", err)
+	}
+
+	// Restore with every follower caught up, so they all install the
+	// snapshot and then append past the gap it leaves in the log.
+	c.WaitForReplication(10)
+	for i := 0; i < 5; i++ {
+		if err := leader.Restore(meta, bytes.NewReader(data), 0); err != nil {
+			c.FailNowf("restore err: %v", err)
+		}
+		for j := 0; j < 10; j++ {
+			if err := leader.Apply([]byte(fmt.Sprintf("after%d", j)), 0).Error(); err != nil {
+				c.FailNowf("apply err: %v", err)
+			}
+		}
+		c.WaitForReplication(20)
+		c.EnsureSame(t)
+	}
+}
+
+func TestRaft_UserRestore_NotLeader(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	meta := &SnapshotMeta{Version: SnapshotVersionMax}
+	err := c.Followers()[0].Restore(meta, bytes.NewReader(nil), 0)
+	if err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestRaft_ApplyBatch(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Keep other writes flowing while the batch is applied.
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			leader.Apply([]byte("other"), 0).Error()
+		}
+	}()
+
+	var cmds [][]byte
+	for i := 0; i < 20; i++ {
+		cmds = append(cmds, []byte(fmt.Sprintf("batch%d", i)))
+	}
+	future := leader.ApplyBatch(cmds, 0)
+	err := future.Error()
+	close(stopCh)
+	<-doneCh
+	if err != nil {
+		c.FailNowf("apply batch err: %v", err)
+	}
+
+	// The FSM should have seen the batch in order, with no other writes
+	// interleaved.
+	responses := future.Responses()
+	if len(responses) != len(cmds) {
+		c.FailNowf("expected %d responses, got %d", len(cmds), len(responses))
+	}
+	first := responses[0].(int)
+	fsm := c.fsms[c.IndexOf(leader)]
+	fsm.Lock()
+	defer fsm.Unlock()
+	for i, resp := range responses {
+		if resp.(int) != first+i {
+			c.FailNowf("responses not contiguous: %v", responses)
+		}
+		if got := string(fsm.logs[first+i-1]); got != string(cmds[i]) {
+			c.FailNowf("expected %q at position %d, got %q", cmds[i], first+i-1, got)
+		}
+	}
+	if future.Index() == 0 {
+		c.FailNowf("bad index: %d", future.Index())
+	}
+}
+
+func TestRaft_ApplyBatch_NotLeader(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	future := c.Followers()[0].ApplyBatch([][]byte{[]byte("a"), []byte("b")}, 0)
+	if err := future.Error(); err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
+	}
+}
+
+func TestRaft_ApplyContext(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	future := leader.ApplyContext(context.Background(), []byte("test"))
+	if err := ErrorContext(context.Background(), future); err != nil {
+		c.FailNowf("apply err: %v", err)
+	}
+	if future.Response().(int) != 1 {
+		c.FailNowf("bad response: %v", future.Response())
+	}
+
+	// Commands whose context is already done are never written to the log.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		if err := leader.ApplyContext(ctx, []byte("cancelled")).Error(); err != context.Canceled {
+			c.FailNowf("expected context.Canceled, got %v", err)
+		}
+	}
+	if err := leader.BarrierContext(ctx).Error(); err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+	if err := leader.AddVoterContext(ctx, "id", "addr", 0).Error(); err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+	target := Membership{Servers: []Server{{Suffrage: Voter, ID: "id", Address: "addr"}}}
+	if err := leader.ChangeMembershipContext(ctx, target, 0).Error(); err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+	follower := c.Followers()[0].serverInternals
+	if err := leader.UpdateServerAddressContext(ctx, follower.localID, "addr", 0).Error(); err != context.Canceled {
+		c.FailNowf("expected context.Canceled, got %v", err)
+	}
+
+	future = leader.ApplyContext(context.Background(), []byte("test"))
+	if err := future.Error(); err != nil {
+		c.FailNowf("apply err: %v", err)
+	}
+	c.WaitForReplication(2)
+	membership := c.getMembership(leader)
+	if len(membership.Servers) != 3 || membership.joint() {
+		c.FailNowf("membership should not have changed: %v", membership)
+	}
+	for _, server := range membership.Servers {
+		if server.ID == follower.localID && server.Address != follower.localAddr {
+			c.FailNowf("membership should not have changed: %v", membership)
+		}
+	}
+
+	// ErrorContext gives up on a command that can't commit.
+	for _, follower := range c.Followers() {
+		c.Disconnect(follower.serverInternals.localAddr)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	future = leader.ApplyContext(context.Background(), []byte("stuck"))
+	if err := ErrorContext(ctx, future); err != context.DeadlineExceeded {
+		c.FailNowf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRaft_VerifyLeaderContext(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	if err := leader.VerifyLeaderContext(context.Background()).Error(); err != nil {
+		c.FailNowf("verify err: %v", err)
+	}
+	if err := c.Followers()[0].VerifyLeaderContext(context.Background()).Error(); err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
+	}
+
+	// Requests whose context is already done are dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		if err := leader.VerifyLeaderContext(ctx).Error(); err != context.Canceled {
+			c.FailNowf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	// ErrorContext gives up on a request that can't reach a quorum.
+	for _, follower := range c.Followers() {
+		c.Disconnect(follower.serverInternals.localAddr)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	future := leader.VerifyLeaderContext(context.Background())
+	if err := ErrorContext(ctx, future); err != context.DeadlineExceeded {
+		c.FailNowf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRaft_StartAsLeader(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.StartAsLeader = true
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	raft := c.rafts[0]
+
+	// Watch leaderCh for change
+	select {
+	case v := <-raft.LeaderCh():
+		if !v {
+			c.FailNowf("should become leader")
+		}
+	case <-time.After(c.conf.HeartbeatTimeout * 4):
+		// Longer than you think as possibility of multiple elections
+		c.FailNowf("timeout becoming leader")
+	}
+
+	// Should be leader
+	if s := c.getState(raft); s != Leader {
+		c.FailNowf("expected leader: %v", s)
+	}
+
+	// Should be able to apply
+	future := raft.Apply([]byte("test"), commitTimeout)
+	if err := future.Error(); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// Check the response
+	if future.Response().(int) != 1 {
+		c.FailNowf("bad response: %v", future.Response())
+	}
+
+	// Check the index
+	if idx := future.Index(); idx == 0 {
+		c.FailNowf("bad index: %d", idx)
+	}
+
+	// Check that it is applied to the FSM
+	if len(c.fsms[0].logs) != 1 {
+		c.FailNowf("did not apply to FSM!")
+	}
+}
+
+func TestRaft_NotifyCh(t *testing.T) {
+	ch := make(chan bool, 1)
+	conf := inmemConfig(t)
+	conf.NotifyCh = ch
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+
+	// Watch leaderCh for change
+	select {
+	case v := <-ch:
+		if !v {
+			c.FailNowf("should become leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 8):
+		c.FailNowf("timeout becoming leader")
+	}
+
+	// Close the cluster
+	c.Close()
+
+	// Watch leaderCh for change
+	select {
+	case v := <-ch:
+		if v {
+			c.FailNowf("should step down as leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 6):
+		c.FailNowf("timeout on step down as leader")
+	}
+}
+
+func TestRaft_Voting(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	followers := c.Followers()
+	ldr := c.Leader()
+	ldrT := c.trans[c.IndexOf(ldr)]
+
+	reqVote := RequestVoteRequest{
+		RPCHeader:    ldr.serverInternals.getRPCHeader(),
+		Term:         c.getTerm(ldr) + 10,
+		Candidate:    ldrT.EncodePeer(ldr.serverInternals.localAddr),
+		LastLogIndex: c.getLastIndex(ldr),
+		LastLogTerm:  c.getTerm(ldr),
+	}
+	// a follower that thinks there's a leader should vote for that leader.
 	var resp RequestVoteResponse
 	if err := ldrT.RequestVote(followers[0].serverInternals.localAddr, &reqVote, &resp); err != nil {
 		c.FailNowf("RequestVote RPC failed %v", err)
@@ -2042,6 +3026,289 @@ func TestRaft_Voting(t *testing.T) {
 	}
 }
 
+func TestRaft_Voting_LeadershipTransfer(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	followers := c.Followers()
+	ldr := c.Leader()
+	ldrT := c.trans[c.IndexOf(ldr)]
+
+	reqVote := RequestVoteRequest{
+		RPCHeader:          ldr.serverInternals.getRPCHeader(),
+		Term:               c.getTerm(ldr) + 10,
+		Candidate:          ldrT.EncodePeer(followers[0].serverInternals.localAddr),
+		LastLogIndex:       c.getLastIndex(ldr),
+		LastLogTerm:        c.getTerm(ldr),
+		LeadershipTransfer: true,
+	}
+	// a follower that thinks there's a leader should vote for a different
+	// candidate if the leader is handing off leadership to it.
+	var resp RequestVoteResponse
+	if err := ldrT.RequestVote(followers[1].serverInternals.localAddr, &reqVote, &resp); err != nil {
+		c.FailNowf("RequestVote RPC failed %v", err)
+	}
+	if !resp.Granted {
+		c.FailNowf("expected vote to be granted, but wasn't %+v", resp)
+	}
+}
+
+func TestRaft_LeadershipTransfer(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	oldLeader := c.Leader()
+	for i := 0; i < 10; i++ {
+		oldLeader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	c.WaitForReplication(10)
+
+	// Followers should refuse to transfer leadership.
+	follower := c.Followers()[0]
+	if err := follower.LeadershipTransfer().Error(); err != ErrNotLeader {
+		c.FailNowf("expected ErrNotLeader, got %v", err)
+	}
+
+	if err := oldLeader.LeadershipTransfer().Error(); err != nil {
+		c.FailNowf("leadership transfer failed: %v", err)
+	}
+	newLeader := c.Leader()
+	if newLeader == oldLeader {
+		c.FailNowf("leadership should have moved off %v", oldLeader)
+	}
+
+	// The new leader should be fully functional.
+	if err := newLeader.Apply([]byte("after"), 0).Error(); err != nil {
+		c.FailNowf("apply failed: %v", err)
+	}
+	c.WaitForReplication(11)
+	c.EnsureSame(t)
+}
+
+func TestRaft_ShutdownGracefully(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	oldLeader := c.Leader()
+	oldAddr := oldLeader.serverInternals.localAddr
+	var futures []ApplyFuture
+	for i := 0; i < 10; i++ {
+		futures = append(futures, oldLeader.Apply([]byte(fmt.Sprintf("test%d", i)), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.longstopTimeout)
+	defer cancel()
+	if err := oldLeader.ShutdownGracefully(ctx); err != nil {
+		c.FailNowf("graceful shutdown failed: %v", err)
+	}
+
+	// Entries accepted before the shutdown were committed, not abandoned.
+	for _, f := range futures {
+		if err := f.Error(); err != nil {
+			c.FailNowf("apply err: %v", err)
+		}
+	}
+	if err := oldLeader.Apply([]byte("late"), 0).Error(); err != ErrRaftShutdown {
+		c.FailNowf("expected ErrRaftShutdown, got %v", err)
+	}
+
+	// Leadership was handed to one of the remaining servers.
+	var others []*Raft
+	for _, r := range c.rafts {
+		if r != oldLeader {
+			others = append(others, r)
+		}
+	}
+	limit := time.Now().Add(c.longstopTimeout)
+	for {
+		leader := others[0].Leader()
+		if leader != "" && leader != oldAddr && others[1].Leader() == leader {
+			break
+		}
+		if time.Now().After(limit) {
+			c.FailNowf("no new leader after graceful shutdown")
+		}
+		time.Sleep(commitTimeout)
+	}
+
+	// The remaining servers shut down gracefully too, whichever is leader.
+	for _, r := range others {
+		if err := r.ShutdownGracefully(ctx); err != nil {
+			c.FailNowf("graceful shutdown failed: %v", err)
+		}
+	}
+}
+
+func TestRaft_ShutdownGracefully_SingleNode(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	// There's no voter to hand off to, so this just shuts down.
+	leader := c.Leader()
+	ctx, cancel := context.WithTimeout(context.Background(), c.longstopTimeout)
+	defer cancel()
+	if err := leader.ShutdownGracefully(ctx); err != nil {
+		c.FailNowf("graceful shutdown failed: %v", err)
+	}
+	if err := leader.Apply([]byte("late"), 0).Error(); err != ErrRaftShutdown {
+		c.FailNowf("expected ErrRaftShutdown, got %v", err)
+	}
+}
+
+func TestRaft_LeadershipTransferToServer(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	target := c.Followers()[1]
+	targetID := target.serverInternals.localID
+	targetAddr := target.serverInternals.localAddr
+
+	// The leader can't hand off to itself or to an unknown server.
+	if err := leader.LeadershipTransferToServer(leader.serverInternals.localID, "").Error(); err == nil {
+		c.FailNowf("expected transfer to self to fail")
+	}
+	if err := leader.LeadershipTransferToServer("unknown", "").Error(); err == nil {
+		c.FailNowf("expected transfer to unknown server to fail")
+	}
+
+	if err := leader.LeadershipTransferToServer(targetID, targetAddr).Error(); err != nil {
+		c.FailNowf("leadership transfer failed: %v", err)
+	}
+	if l := c.Leader(); l != target {
+		c.FailNowf("expected %v to be leader, got %v", targetAddr, l)
+	}
+}
+
+func TestRaft_LeadershipTransfer_Timeout(t *testing.T) {
+	// The transfer gives up after an election timeout, so make that long
+	// enough to observe the transfer in progress.
+	conf := inmemConfig(t)
+	conf.ElectionTimeout = 500 * time.Millisecond
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	target := c.Followers()[0]
+
+	// With the target disconnected, it can never catch up to receive TimeoutNow.
+	c.Disconnect(target.serverInternals.localAddr)
+	future := leader.LeadershipTransferToServer(target.serverInternals.localID, "")
+
+	// New entries are rejected while the transfer is in progress.
+	if err := leader.Apply([]byte("test"), 0).Error(); err != ErrLeadershipTransferInProgress {
+		c.FailNowf("expected ErrLeadershipTransferInProgress, got %v", err)
+	}
+	if err := leader.LeadershipTransfer().Error(); err != ErrLeadershipTransferInProgress {
+		c.FailNowf("expected ErrLeadershipTransferInProgress, got %v", err)
+	}
+
+	if err := future.Error(); err == nil {
+		c.FailNowf("expected leadership transfer to time out")
+	}
+
+	// The leader carries on once the transfer is abandoned.
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		c.FailNowf("apply failed: %v", err)
+	}
+}
+
+func TestRaft_Voting_PreVote(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	followers := c.Followers()
+	ldr := c.Leader()
+	ldrT := c.trans[c.IndexOf(ldr)]
+	term := c.getTerm(ldr)
+
+	reqVote := RequestVoteRequest{
+		RPCHeader:    ldr.serverInternals.getRPCHeader(),
+		Term:         term + 10,
+		Candidate:    ldrT.EncodePeer(ldr.serverInternals.localAddr),
+		LastLogIndex: c.getLastIndex(ldr),
+		LastLogTerm:  term,
+		PreVote:      true,
+	}
+	// a follower should answer a pre-vote without changing its term.
+	var resp RequestVoteResponse
+	if err := ldrT.RequestVote(followers[0].serverInternals.localAddr, &reqVote, &resp); err != nil {
+		c.FailNowf("RequestVote RPC failed %v", err)
+	}
+	if !resp.Granted || !resp.PreVote || resp.Term != term {
+		c.FailNowf("expected pre-vote to be granted in term %v, but got %+v", term, resp)
+	}
+	if got := c.getTerm(followers[0]); got != term {
+		c.FailNowf("pre-vote should not change the term, got %v want %v", got, term)
+	}
+
+	// a follower that thinks there's a leader shouldn't pre-vote for a different candidate
+	reqVote.Candidate = ldrT.EncodePeer(followers[0].serverInternals.localAddr)
+	if err := ldrT.RequestVote(followers[1].serverInternals.localAddr, &reqVote, &resp); err != nil {
+		c.FailNowf("RequestVote RPC failed %v", err)
+	}
+	if resp.Granted {
+		c.FailNowf("expected pre-vote not to be granted, but was %+v", resp)
+	}
+}
+
+func TestRaft_PreVote(t *testing.T) {
+	conf := inmemConfig(t)
+	conf.PreVote = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// A leader gets elected through the pre-vote round.
+	leader := c.Leader()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		c.FailNowf("apply failed: %v", err)
+	}
+	c.WaitForReplication(1)
+
+	// Leadership transfers skip the pre-vote round and still work.
+	if err := leader.LeadershipTransfer().Error(); err != nil {
+		c.FailNowf("leadership transfer failed: %v", err)
+	}
+	if c.Leader() == leader {
+		c.FailNowf("leadership should have moved off %v", leader)
+	}
+}
+
+func TestRaft_PreVote_Rejoin(t *testing.T) {
+	// Use longer timeouts than usual, so that the leader doesn't lose its
+	// lease and bump the term on a loaded machine.
+	conf := inmemConfig(t)
+	conf.HeartbeatTimeout = 200 * time.Millisecond
+	conf.ElectionTimeout = 200 * time.Millisecond
+	conf.LeaderLeaseTimeout = 200 * time.Millisecond
+	conf.PreVote = true
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	leader := c.Leader()
+	term := c.getTerm(leader)
+	follower := c.Followers()[0]
+
+	// Isolate a follower for several election timeouts. Without a quorum of
+	// pre-votes it should never bump its term.
+	c.Disconnect(follower.serverInternals.localAddr)
+	time.Sleep(10 * conf.ElectionTimeout)
+	if got := c.getTerm(follower); got != term {
+		c.FailNowf("isolated follower changed term from %v to %v", term, got)
+	}
+
+	// Rejoining shouldn't depose the leader.
+	c.FullyConnect()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		c.FailNowf("apply failed: %v", err)
+	}
+	c.WaitForReplication(1)
+	if got := c.getTerm(leader); got != term {
+		c.FailNowf("leader changed term from %v to %v", term, got)
+	}
+	if c.Leader() != leader {
+		c.FailNowf("leader should not have changed")
+	}
+}
+
 func TestRaft_ProtocolVersion_RejectRPC(t *testing.T) {
 	c := MakeCluster(3, t, nil)
 	defer c.Close()
@@ -2153,6 +3420,168 @@ func TestRaft_ProtocolVersion_Upgrade_2_3(t *testing.T) {
 	}
 }
 
+func TestRaft_ProtocolVersion_Negotiate(t *testing.T) {
+	// Make a cluster configured for protocol version 3.
+	conf := inmemConfig(t)
+	conf.ProtocolVersion = 3
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if err := c.Leader().Apply([]byte("test"), commitTimeout).Error(); err != nil {
+			c.FailNowf("err: %v", err)
+		}
+	}
+	c.WaitForReplication(3)
+
+	// Every server understands the newest version, so they all move to it.
+	deadline := time.Now().Add(5 * time.Second)
+	for _, r := range c.rafts {
+		for c.getStats(r).ProtocolVersion != ProtocolVersionMax {
+			if time.Now().After(deadline) {
+				c.FailNowf("%v still speaking version %v",
+					r.serverInternals.localID, c.getStats(r).ProtocolVersion)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Send a follower an AppendEntries whose previous entry doesn't match.
+	ldr := c.Leader()
+	ldrT := c.trans[c.IndexOf(ldr)]
+	follower := c.Followers()[0]
+	store := c.stores[c.IndexOf(follower)]
+	lastIdx := c.getLastIndex(follower)
+	var last Log
+	if err := store.GetLog(lastIdx, &last); err != nil {
+		c.FailNowf("err: %v", err)
+	}
+	firstIdx := lastIdx
+	for firstIdx > 1 {
+		var prev Log
+		if err := store.GetLog(firstIdx-1, &prev); err != nil || prev.Term != last.Term {
+			break
+		}
+		firstIdx--
+	}
+	req := AppendEntriesRequest{
+		RPCHeader:    ldr.serverInternals.getRPCHeader(),
+		Term:         c.getTerm(ldr),
+		Leader:       ldrT.EncodePeer(ldr.serverInternals.localAddr),
+		PrevLogEntry: lastIdx,
+		PrevLogTerm:  last.Term + 1,
+	}
+	var resp AppendEntriesResponse
+	err := ldrT.AppendEntries(follower.serverInternals.localAddr, &req, &resp)
+	if err != nil {
+		c.FailNowf("err: %v", err)
+	}
+
+	// The follower points at the start of its conflicting term.
+	if resp.Success || resp.ConflictTerm != last.Term || resp.ConflictIndex != firstIdx {
+		c.FailNowf("expected conflict at term %v index %v, got %+v",
+			last.Term, firstIdx, resp)
+	}
+}
+
+func TestRaft_ProtocolVersion_NoConflictHints(t *testing.T) {
+	// Make two servers configured for protocol version 3 that never form a
+	// cluster, so nothing negotiates them up to a newer version.
+	conf := inmemConfig(t)
+	conf.ProtocolVersion = 3
+	c := MakeClusterNoBootstrap(2, t, conf)
+	defer c.Close()
+	ldr, follower := c.rafts[0], c.rafts[1]
+	ldrT := c.trans[0]
+
+	// Give the follower a few entries from term 2, speaking version 3.
+	send := func(req *AppendEntriesRequest) AppendEntriesResponse {
+		t.Helper()
+		var resp AppendEntriesResponse
+		err := ldrT.AppendEntries(follower.serverInternals.localAddr, req, &resp)
+		if err != nil {
+			c.FailNowf("err: %v", err)
+		}
+		return resp
+	}
+	req := AppendEntriesRequest{
+		RPCHeader: RPCHeader{ProtocolVersion: 3},
+		Term:      2,
+		Leader:    ldrT.EncodePeer(ldr.serverInternals.localAddr),
+	}
+	for i := Index(1); i <= 3; i++ {
+		req.Entries = append(req.Entries, &Log{Index: i, Term: 2, Type: LogCommand})
+	}
+	if resp := send(&req); !resp.Success {
+		c.FailNowf("expected AppendEntries to succeed: %+v", resp)
+	}
+	if v := c.getStats(follower).ProtocolVersion; v != 3 {
+		c.FailNowf("follower speaking version %v, expected 3", v)
+	}
+
+	// A version 3 follower rejects a mismatching previous entry without
+	// giving conflict hints.
+	req.Entries = nil
+	req.PrevLogEntry = 3
+	req.PrevLogTerm = 1
+	resp := send(&req)
+	if resp.Success || resp.ConflictTerm != 0 || resp.ConflictIndex != 0 {
+		c.FailNowf("version 3 follower shouldn't give conflict hints: %+v", resp)
+	}
+
+	// Once the leader speaks version 4, the follower gives hints.
+	req.RPCHeader = RPCHeader{ProtocolVersion: 4}
+	resp = send(&req)
+	if resp.Success || resp.ConflictTerm != 2 || resp.ConflictIndex != 1 {
+		c.FailNowf("expected conflict at term 2 index 1, got %+v", resp)
+	}
+}
+
+func TestRaft_NegotiateProtocolVersion(t *testing.T) {
+	r := &raftServer{
+		conf:            Config{ProtocolVersion: 3},
+		protocolVersion: 3,
+		localID:         "s1",
+		logger:          newTestLogger(t),
+		shared:          &raftShared{protocolVersion: 3},
+		peers:           map[ServerID]*raftPeer{"s2": {}, "s3": {}},
+	}
+	r.memberships.latest = Membership{
+		Servers: []Server{{ID: "s1"}, {ID: "s2"}, {ID: "s3"}},
+	}
+	expect := func(changed bool, version ProtocolVersion) {
+		t.Helper()
+		if r.negotiateProtocolVersion() != changed {
+			t.Fatalf("expected changed to be %v", changed)
+		}
+		if r.protocolVersion != version || r.shared.getProtocolVersion() != version {
+			t.Fatalf("expected version %v, got %v", version, r.protocolVersion)
+		}
+	}
+
+	// Peers that haven't replied are assumed to understand only version 3.
+	expect(false, 3)
+	r.peers["s2"].progress.protocolVersionMax = ProtocolVersionMax
+	expect(false, 3)
+
+	// Once everyone understands the newest version, it's used.
+	r.peers["s3"].progress.protocolVersionMax = ProtocolVersionMax
+	expect(true, ProtocolVersionMax)
+
+	// A new member that hasn't replied yet holds it back again.
+	r.memberships.latest.Servers = append(r.memberships.latest.Servers, Server{ID: "s4"})
+	expect(true, 3)
+
+	// The configured version is never negotiated down.
+	r.conf.ProtocolVersion = ProtocolVersionMax
+	r.peers["s2"].progress.protocolVersionMax = 3
+	expect(true, ProtocolVersionMax)
+
+	// Nor is anything before version 3.
+	r.conf.ProtocolVersion = 2
+	r.setProtocolVersion(2)
+	expect(false, 2)
+}
+
 // TODO: These are test cases we'd like to write for appendEntries().
 // Unfortunately, it's difficult to do so with the current way this file is
 // tested.
@@ -2211,3 +3640,116 @@ func TestRaft_quorumGeq(t *testing.T) {
 		}
 	}
 }
+
+func TestRaft_Observer(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+	followerID := follower.serverInternals.localID
+
+	observations := make(chan Observation, 100)
+	observer := NewObserver(observations, false, func(o *Observation) bool {
+		switch o.Data.(type) {
+		case PeerObservation, FailedHeartbeatObservation, ResumedHeartbeatObservation:
+			return true
+		}
+		return false
+	})
+	leader.RegisterObserver(observer)
+	defer leader.DeregisterObserver(observer)
+
+	expect := func(match func(interface{}) bool) {
+		deadline := time.After(c.longstopTimeout)
+		for {
+			select {
+			case o := <-observations:
+				switch o.Data.(type) {
+				case PeerObservation, FailedHeartbeatObservation, ResumedHeartbeatObservation:
+				default:
+					c.FailNowf("filtered observation delivered: %#v", o.Data)
+				}
+				if match(o.Data) {
+					return
+				}
+			case <-deadline:
+				c.FailNowf("timed out waiting for observation")
+			}
+		}
+	}
+
+	c.Disconnect(follower.serverInternals.localAddr)
+	expect(func(data interface{}) bool {
+		o, ok := data.(FailedHeartbeatObservation)
+		return ok && o.PeerID == followerID && !o.LastContact.IsZero()
+	})
+
+	c.FullyConnect()
+	expect(func(data interface{}) bool {
+		o, ok := data.(ResumedHeartbeatObservation)
+		return ok && o.PeerID == followerID
+	})
+
+	if err := leader.RemoveServer(followerID, 0, 0).Error(); err != nil {
+		c.FailNowf("remove server err: %v", err)
+	}
+	expect(func(data interface{}) bool {
+		o, ok := data.(PeerObservation)
+		return ok && o.Removed && o.Peer.ID == followerID
+	})
+
+	if observer.GetNumObserved() < 3 {
+		c.FailNowf("expected at least 3 observations, got %v", observer.GetNumObserved())
+	}
+}
+
+func TestRaft_Observer_Leader(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	follower := c.Followers()[0]
+
+	observations := make(chan Observation, 100)
+	observer := NewObserver(observations, true, func(o *Observation) bool {
+		_, ok := o.Data.(LeaderObservation)
+		return ok
+	})
+	follower.RegisterObserver(observer)
+	defer follower.DeregisterObserver(observer)
+
+	leader := c.Leader()
+	c.Disconnect(leader.serverInternals.localAddr)
+	deadline := time.After(c.longstopTimeout)
+	for {
+		select {
+		case o := <-observations:
+			lo := o.Data.(LeaderObservation)
+			if lo.LeaderAddr != "" && lo.LeaderID != leader.serverInternals.localID {
+				return
+			}
+		case <-deadline:
+			c.FailNowf("timed out waiting for a new leader observation")
+		}
+	}
+}
+
+func TestRaft_Observer_Dropped(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Nothing reads from an unbuffered channel, so every observation is
+	// dropped rather than blocking the server.
+	observer := NewObserver(make(chan Observation), false, nil)
+	leader.RegisterObserver(observer)
+	leader.serverInternals.observe(LeaderObservation{})
+	if observer.GetNumDropped() != 1 || observer.GetNumObserved() != 0 {
+		c.FailNowf("expected 1 dropped and 0 observed, got %v and %v",
+			observer.GetNumDropped(), observer.GetNumObserved())
+	}
+
+	leader.DeregisterObserver(observer)
+	leader.serverInternals.observe(LeaderObservation{})
+	if observer.GetNumDropped() != 1 {
+		c.FailNowf("deregistered observer still received observations")
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"io"
 	"time"
-
-	"github.com/armon/go-metrics"
 )
 
 // SnapshotMeta is for metadata of a snapshot.
@@ -91,15 +89,24 @@ func (r *raftServer) runSnapshots() {
 			}
 
 			// Trigger a snapshot
-			if err := r.takeSnapshot(); err != nil {
+			if _, err := r.takeSnapshot(); err != nil {
 				r.logger.Error("Failed to take snapshot", "error", err)
 			}
 
 		case future := <-r.api.snapshotCh:
 			// User-triggered, run immediately
-			err := r.takeSnapshot()
+			id, err := r.takeSnapshot()
 			if err != nil {
 				r.logger.Error("Failed to take snapshot", "error", err)
+			} else {
+				// Open it now, so that later snapshots can't reap it before
+				// the caller gets to Open it.
+				meta, reader, openErr := r.snapshots.Open(id)
+				if openErr != nil {
+					err = fmt.Errorf("failed to open snapshot: %v", openErr)
+				} else {
+					future.opened(meta, reader)
+				}
 			}
 			future.respond(err)
 
@@ -128,9 +135,10 @@ func (r *raftServer) shouldSnapshot() bool {
 }
 
 // takeSnapshot is used to take a new snapshot. This must only be called from
-// the snapshot thread, never the main thread.
-func (r *raftServer) takeSnapshot() error {
-	defer metrics.MeasureSince([]string{"raft", "snapshot", "takeSnapshot"}, time.Now())
+// the snapshot thread, never the main thread. This returns the ID of the new
+// snapshot, along with an error.
+func (r *raftServer) takeSnapshot() (string, error) {
+	defer r.metrics.MeasureSince([]string{"raft", "snapshot", "takeSnapshot"}, time.Now())
 
 	// Create a request for the FSM to perform a snapshot.
 	snapReq := &reqSnapshotFuture{}
@@ -140,7 +148,7 @@ func (r *raftServer) takeSnapshot() error {
 	select {
 	case r.fsmSnapshotCh <- snapReq:
 	case <-r.api.shutdownCh:
-		return ErrRaftShutdown
+		return "", ErrRaftShutdown
 	}
 
 	// Wait until we get a response
@@ -148,7 +156,7 @@ func (r *raftServer) takeSnapshot() error {
 		if err != ErrNothingNewToSnapshot {
 			err = fmt.Errorf("failed to start snapshot: %v", err)
 		}
-		return err
+		return "", err
 	}
 	defer snapReq.snapshot.Release()
 
@@ -160,10 +168,10 @@ func (r *raftServer) takeSnapshot() error {
 	select {
 	case r.api.membershipsCh <- configReq:
 	case <-r.api.shutdownCh:
-		return ErrRaftShutdown
+		return "", ErrRaftShutdown
 	}
 	if err := configReq.Error(); err != nil {
-		return err
+		return "", err
 	}
 	committed := configReq.memberships.committed
 	committedIndex := configReq.memberships.committedIndex
@@ -177,31 +185,31 @@ func (r *raftServer) takeSnapshot() error {
 	// then it's not crucial that we snapshot, since there's not much going
 	// on Raft-wise.
 	if snapReq.index < committedIndex {
-		return fmt.Errorf("cannot take snapshot now, wait until the configuration entry at %v has been applied (have applied %v)",
+		return "", fmt.Errorf("cannot take snapshot now, wait until the configuration entry at %v has been applied (have applied %v)",
 			committedIndex, snapReq.index)
 	}
 
 	// Create a new snapshot.
 	r.logger.Info("Starting snapshot", "index", snapReq.index)
 	start := time.Now()
-	version := getSnapshotVersion(r.protocolVersion)
+	version := getSnapshotVersion(r.shared.getProtocolVersion())
 	sink, err := r.snapshots.Create(version, snapReq.index, snapReq.term, committed, committedIndex, r.trans)
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %v", err)
+		return "", fmt.Errorf("failed to create snapshot: %v", err)
 	}
-	metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
+	r.metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
 
 	// Try to persist the snapshot.
 	start = time.Now()
 	if err := snapReq.snapshot.Persist(sink); err != nil {
 		sink.Cancel()
-		return fmt.Errorf("failed to persist snapshot: %v", err)
+		return "", fmt.Errorf("failed to persist snapshot: %v", err)
 	}
-	metrics.MeasureSince([]string{"raft", "snapshot", "persist"}, start)
+	r.metrics.MeasureSince([]string{"raft", "snapshot", "persist"}, start)
 
 	// Close and check for error.
 	if err := sink.Close(); err != nil {
-		return fmt.Errorf("failed to close snapshot: %v", err)
+		return "", fmt.Errorf("failed to close snapshot: %v", err)
 	}
 
 	// Update the last stable snapshot info.
@@ -209,17 +217,17 @@ func (r *raftServer) takeSnapshot() error {
 
 	// Compact the logs.
 	if err := r.compactLogs(snapReq.index); err != nil {
-		return err
+		return "", err
 	}
 
 	r.logger.Info("Snapshot complete", "index", snapReq.index)
-	return nil
+	return sink.ID(), nil
 }
 
 // compactLogs takes the last inclusive index of a snapshot
 // and trims the logs that are no longer needed.
 func (r *raftServer) compactLogs(snapIdx Index) error {
-	defer metrics.MeasureSince([]string{"raft", "compactLogs"}, time.Now())
+	defer r.metrics.MeasureSince([]string{"raft", "compactLogs"}, time.Now())
 	// Determine log ranges to compact
 	minLog, err := r.logs.FirstIndex()
 	if err != nil {
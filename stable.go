@@ -1,15 +1,47 @@
 package raft
 
+import "errors"
+
+var (
+	// ErrKeyNotFound may be returned by a StableStore for a key that was
+	// never set. Raft recognizes any error whose message is "not found".
+	ErrKeyNotFound = errors.New("not found")
+)
+
 // StableStore is used to provide stable storage
 // of key configurations to ensure safety.
 type StableStore interface {
 	Set(key []byte, val []byte) error
 
-	// Get returns the value for key, or an empty byte slice if key was not found.
+	// Get returns the value for key. If key was not found, it returns either
+	// an empty byte slice or an error whose message is "not found".
 	Get(key []byte) ([]byte, error)
 
 	SetUint64(key []byte, val uint64) error
 
-	// GetUint64 returns the uint64 value for key, or 0 if key was not found.
+	// GetUint64 returns the uint64 value for key. If key was not found, it
+	// returns either 0 or an error whose message is "not found".
 	GetUint64(key []byte) (uint64, error)
 }
+
+// StableStoreBatch is an optional extension of StableStore for stores that can
+// write several keys atomically. When the StableStore passed to NewRaft
+// implements it, Raft saves its current term and vote in a single batch, so
+// that a crash can't leave behind a term and vote that never existed together.
+type StableStoreBatch interface {
+	StableStore
+
+	// SetBatch applies all of the writes, in order, or none of them.
+	SetBatch(writes []StableWrite) error
+}
+
+// StableWrite is one write in a StableStoreBatch.SetBatch call.
+type StableWrite struct {
+	Key []byte
+
+	// IsUint64 selects whether this write is like SetUint64(Key, Uint64) or
+	// like Set(Key, Val).
+	IsUint64 bool
+	Val      []byte
+	Uint64   uint64
+}
@@ -5,8 +5,6 @@ import (
 	"io"
 	"net"
 	"time"
-
-	log "github.com/mgutz/logxi/v1"
 )
 
 var (
@@ -41,7 +39,7 @@ func NewTCPTransportWithLogger(
 	advertise net.Addr,
 	maxPool int,
 	timeout time.Duration,
-	logger log.Logger,
+	logger Logger,
 ) (*NetworkTransport, error) {
 	return newTCPTransport(bindAddr, advertise, maxPool, timeout, func(stream StreamLayer) *NetworkTransport {
 		return NewNetworkTransportWithLogger(stream, maxPool, timeout, logger)
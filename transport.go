@@ -57,6 +57,12 @@ type Transport interface {
 	// the ReadCloser and streamed to the client.
 	InstallSnapshot(target ServerAddress, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error
 
+	// TimeoutNow is used to start a leadership transfer to the target node.
+	TimeoutNow(target ServerAddress, args *TimeoutNowRequest, resp *TimeoutNowResponse) error
+
+	// ReadIndex is used by a follower to get a read index from the leader.
+	ReadIndex(target ServerAddress, args *ReadIndexRequest, resp *ReadIndexResponse) error
+
 	// EncodePeer is used to serialize a peer's address.
 	EncodePeer(ServerAddress) []byte
 